@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/mdickers47/mtool/db"
-	"github.com/mdickers47/mtool/xfm"
+	"github.com/mdickers47/mtool/pkg/db"
+	"github.com/mdickers47/mtool/pkg/xfm"
 )
 
+// rootCtx is canceled on SIGINT (ctrl-C), so a long-running "make" can stop
+// dispatching new jobs and clean up in-flight ones instead of leaving the
+// terminal to ctrl-C out of a half-written library.
+var rootCtx context.Context
+
 type Command struct {
-	Func    func(mdb *db.MediaDB, args []string) bool
+	Func    func(store db.Store, mdb *db.MediaDB, args []string) bool
 	Help    string
 	MinArgs int
 	MaxArgs int
@@ -31,27 +39,29 @@ var CommandByName = map[string]Command{
 		"output most recent n master files (arg: n)", 1, 1},
 	"make": {Make,
 		"transcode and create output image (args: imager, /output/path)", 2, 2},
+	"cache": {Cache,
+		"manage the -cache encode cache (args: prune|verify, [max-age])", 1, 2},
 }
 
-func Info(mdb *db.MediaDB, args []string) bool {
+func Info(store db.Store, mdb *db.MediaDB, args []string) bool {
 	fmt.Printf("library file at %v contains %v master files\n", *db.Dbfile,
 		len(mdb.MasterFiles))
-	i, keys := 0, make([]string, len(db.HandlerByExt))
-	for key, _ := range db.HandlerByExt {
-		keys[i] = key
-		i++
-	}
-	fmt.Printf("available master file handlers: %v\n", strings.Join(keys, ", "))
-	i, keys = 0, make([]string, len(xfm.Byname))
-	for key, _ := range xfm.Byname {
-		keys[i] = key
-		i++
-	}
-	fmt.Printf("available image types: %v\n", strings.Join(keys, ", "))
+	fmt.Print("active tag-reader backends:\n")
+	for _, r := range db.TagReaders() {
+		fmt.Printf("  %-20v %v\n", r.Name(), strings.Join(r.Extensions(), ", "))
+	}
+	ffprobeVersion, ffmpegVersion := db.ProbeVersions()
+	fmt.Printf("ffprobe: %v\n", ffprobeVersion)
+	fmt.Printf("ffmpeg:  %v\n", ffmpegVersion)
+	keys := make([]string, 0, len(xfm.Transcoders()))
+	for _, t := range xfm.Transcoders() {
+		keys = append(keys, t.Name())
+	}
+	fmt.Printf("available output formats: %v\n", strings.Join(keys, ", "))
 	return false
 }
 
-func Scan(mdb *db.MediaDB, _ []string) bool {
+func Scan(store db.Store, mdb *db.MediaDB, _ []string) bool {
 	fmt.Printf("rescanning %v\n", mdb.FileRoot)
 	err := db.ScanFiles(mdb, os.Stdout)
 	if err != nil {
@@ -60,7 +70,7 @@ func Scan(mdb *db.MediaDB, _ []string) bool {
 	return true
 }
 
-func Init(mdb *db.MediaDB, args []string) bool {
+func Init(store db.Store, mdb *db.MediaDB, args []string) bool {
 	fmt.Printf("creating new library from %v\n", args[0])
 	mdb.FileRoot = args[0]
 	mdb.MasterFiles = make([]db.MasterFile, 0, 100)
@@ -71,10 +81,10 @@ func Init(mdb *db.MediaDB, args []string) bool {
 	return true
 }
 
-func Find(mdb *db.MediaDB, args []string) bool {
+func Find(store db.Store, mdb *db.MediaDB, args []string) bool {
 	var paths []string
 	for _, arg := range args {
-		new_paths, err := mdb.RegexSearch(arg)
+		new_paths, err := store.Search(arg)
 		if err != nil {
 			fmt.Printf("regex error: %v\n", err)
 			return false
@@ -87,33 +97,67 @@ func Find(mdb *db.MediaDB, args []string) bool {
 	return false
 }
 
-func Latest(mdb *db.MediaDB, args []string) bool {
+func Latest(store db.Store, mdb *db.MediaDB, args []string) bool {
 	var n int
 	if len(args) == 0 {
 		n = 10
 	} else {
 		var err error
-		n, err = strconv.Atoi(args[1])
+		n, err = strconv.Atoi(args[0])
 		if err != nil {
 			fmt.Printf("bad argument: %v\n", err)
 			return false
 		}
 	}
-	paths := mdb.Latest(n)
+	paths, err := store.Latest(n)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return false
+	}
 	for i := range paths {
 		fmt.Println(paths[i])
 	}
 	return false
 }
 
-func Make(mdb *db.MediaDB, args []string) bool {
-	err := xfm.MakeImage(mdb, args[0], args[1])
+func Make(store db.Store, mdb *db.MediaDB, args []string) bool {
+	progress := func(p xfm.Progress) {
+		if p.Err != nil {
+			fmt.Printf("[%v/%v] failed: %v: %v\n", p.Done, p.Total, p.ImagePath, p.Err)
+		}
+	}
+	err := xfm.MakeImage(rootCtx, mdb, args[0], args[1], progress)
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 	}
 	return false
 }
 
+func Cache(store db.Store, mdb *db.MediaDB, args []string) bool {
+	switch args[0] {
+	case "prune":
+		maxAge := 90 * 24 * time.Hour
+		if len(args) > 1 {
+			var err error
+			maxAge, err = time.ParseDuration(args[1])
+			if err != nil {
+				fmt.Printf("bad max-age: %v\n", err)
+				return false
+			}
+		}
+		if err := xfm.CachePrune(maxAge); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	case "verify":
+		if err := xfm.CacheVerify(); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	default:
+		fmt.Printf("unknown cache subcommand %q, expected prune|verify\n", args[0])
+	}
+	return false
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: mtool [-flags] command arg...\n\n")
 	fmt.Fprintf(os.Stderr, "flags:\n")
@@ -127,10 +171,22 @@ func usage() {
 func main() {
 	flag.Parse()
 
-	mediadb, err := db.LoadDb()
+	var cancel context.CancelFunc
+	rootCtx, cancel = signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	store, err := db.OpenStore()
 	if err != nil {
-		fmt.Printf("unable to load %v: %v\n", *db.Dbfile, err)
+		fmt.Printf("unable to open %v: %v\n", *db.Dbfile, err)
 		fmt.Print("fix the problem or re-initialize with 'init /path/to/root'\n")
+		return
+	}
+	defer store.Close()
+
+	mediadb, err := loadMediaDb(store)
+	if err != nil {
+		fmt.Printf("unable to load %v: %v\n", *db.Dbfile, err)
+		return
 	}
 
 	cmd, ok := CommandByName[flag.Arg(0)]
@@ -145,15 +201,56 @@ func main() {
 		return
 	}
 
-	dirtydb := cmd.Func(&mediadb, args)
+	before := mediadb
+	dirtydb := cmd.Func(store, &mediadb, args)
 
 	if dirtydb {
 		fmt.Printf("saving library %v of %v files\n",
 			*db.Dbfile, len(mediadb.MasterFiles))
-		err = db.SaveDb(mediadb)
-		if err != nil {
+		if err := saveMediaDb(store, before, mediadb); err != nil {
 			fmt.Printf("failed to save: %v\n", err)
 		}
 	}
 
 }
+
+// loadMediaDb reconstructs the in-memory, whole-slice MediaDB that
+// ScanFiles/RegexSearch/Latest expect from whatever store is backing
+// *db.Dbfile.  Find and Latest talk to store directly instead, so this
+// snapshot only matters for Scan/Init, Make, and Info's file count.
+func loadMediaDb(store db.Store) (db.MediaDB, error) {
+	var mdb db.MediaDB
+	fileRoot, err := store.FileRoot()
+	if err != nil {
+		return mdb, err
+	}
+	masterFiles, err := store.Iter()
+	if err != nil {
+		return mdb, err
+	}
+	mdb.FileRoot = fileRoot
+	mdb.MasterFiles = masterFiles
+	return mdb, nil
+}
+
+// saveMediaDb writes back whatever Scan/Init did to mdb: Put every
+// surviving MasterFile, Delete any that were in before but dropped by
+// ScanFiles' mark-and-sweep (mdb.compact() already removed them from the
+// slice by this point), and persist the possibly-new FileRoot.
+func saveMediaDb(store db.Store, before, after db.MediaDB) error {
+	afterPaths := make(map[string]bool, len(after.MasterFiles))
+	for _, mf := range after.MasterFiles {
+		afterPaths[mf.Path] = true
+		if err := store.Put(mf); err != nil {
+			return err
+		}
+	}
+	for _, mf := range before.MasterFiles {
+		if !afterPaths[mf.Path] {
+			if err := store.Delete(mf.Path); err != nil {
+				return err
+			}
+		}
+	}
+	return store.SetFileRoot(after.FileRoot)
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// contentHashBlockSize is how much of the start and end of a file goes into
+// ComputeContentHash.  Hashing the whole file would make scans of large
+// libraries far slower; in practice a media file that shares size, mtime,
+// and its first/last 64KB with another is the same file.
+const contentHashBlockSize = 64 * 1024
+
+// ComputeContentHash returns a cheap content fingerprint for the file at
+// path: its size and mtime, plus a SHA-256 of its first and last block.
+// It does not depend on the path, which is what lets xfm's encode cache
+// recognize a master file across a rename or a second scan of a tree
+// copied with its mtimes preserved.  A copy that gets a new mtime gets a
+// new hash.
+func ComputeContentHash(path string, info os.FileInfo) (string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	head := make([]byte, contentHashBlockSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	h.Write(head[:n])
+
+	size := info.Size()
+	if size > int64(contentHashBlockSize) {
+		tailStart := size - int64(contentHashBlockSize)
+		if tailStart < int64(n) {
+			tailStart = int64(n)
+		}
+		if _, err := f.Seek(tailStart, io.SeekStart); err != nil {
+			return "", err
+		}
+		tail := make([]byte, size-tailStart)
+		if _, err := io.ReadFull(f, tail); err != nil {
+			return "", err
+		}
+		h.Write(tail)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	return fmt.Sprintf("%v-%v-%v", size, info.ModTime().Unix(), sum), nil
+}
@@ -19,10 +19,13 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 var Dbfile = flag.String("dbfile", "~/.mtooldb", "JSON cache file")
+var ScanWorkers = flag.Int("scan-workers", 4,
+	"how many files to inspect (ffprobe, tag parsing, ...) concurrently during a scan")
 
 type MediaType uint8
 
@@ -31,13 +34,29 @@ const (
 	Video
 	Audio
 	Subtitle
+	Image
 )
 
 type MpegStreamDesc struct {
-	Type     MediaType
-	Codec    string
-	Language string
-	Bitrate  int
+	Type          MediaType
+	Codec         string
+	CodecLongName string
+	Language      string
+	Bitrate       int
+	SampleRate    int
+	Channels      int
+	ChannelLayout string
+	Width         int
+	Height        int
+	FrameRate     string
+	Default       bool
+	Forced        bool
+}
+
+type MpegChapter struct {
+	Title string
+	Start float64
+	End   float64
 }
 
 type MpegDesc struct {
@@ -59,7 +78,15 @@ type ImageFile struct {
 	Artist      string
 	Album       string
 	Track       int
+	// TrackMax, if set, is the total track count of the source album, for
+	// a transformer that wants to tag "N/M" instead of a bare N.
+	TrackMax    int
 	Stream      []MpegStreamDesc
+	ContentHash string
+	// PicturePath, if set, is the path of a cover image already extracted
+	// from the master file, so a Make function that wants to embed or mux
+	// in cover art doesn't have to re-extract it from the master.
+	PicturePath string
 }
 
 // MasterFile represents one master file, which is the preimage to one or more
@@ -80,6 +107,17 @@ type MasterFile struct {
 	Show       string // only likely to be useful when Type == Video
 	Episode    string
 	Stream     []MpegStreamDesc
+	Chapters   []MpegChapter // only likely to be useful when Type == Video
+	// ContentHash identifies the file by its size, mtime and bytes,
+	// independent of its path, so that xfm's encode cache can recognize
+	// the same master after a rename or a second scan of a tree copied
+	// with its mtimes preserved.  See ComputeContentHash.
+	ContentHash string
+	// TagReaderName records which registered TagReader successfully
+	// inspected this file (see readersFor), so a future rescan can tell
+	// whether a newly registered, more capable backend is available for
+	// a row that an earlier, weaker backend already claimed.
+	TagReaderName string
 }
 
 // a MediaDB is just a list of MasterFiles, plus we save the FileRoot so that
@@ -89,22 +127,6 @@ type MediaDB struct {
 	MasterFiles []MasterFile
 }
 
-// a MasterFileHandler is a function that does the format-specific inspection
-// to populate the metadata database.  These are fragile and have a lot of
-// fragile dependencies, so they are separated into modules for easier
-// maintenance.
-type MasterFileHandler func(*MasterFile) error
-
-// the handlerByExt map will be used to determine which intake handler to
-// invoke on each master file in the library.
-var HandlerByExt = map[string]MasterFileHandler{
-	"flac": inspectFlac,
-	"mkv":  inspectMpeg,
-	"m4a":  inspectMp3,
-	"mp3":  inspectMp3,
-	"mp4":  inspectMpeg,
-}
-
 // compact() deletes all of the MasterFiles in mdb where Valid == false.
 // Note that it does not delete any actual files from disk.
 func (mdb *MediaDB) compact() {
@@ -222,17 +244,22 @@ func NewMasterFile(path string, info os.FileInfo) *MasterFile {
 	mf.Path = path
 	mf.Mtime = info.ModTime()
 
-	// perform any format-specific inspection for metadata
-	handler, ok := HandlerByExt[Extension(info.Name())]
-	if !ok {
-		// we have no handler for this file type; ignore it
+	// try each registered reader for this extension in turn, keeping the
+	// first one that succeeds; this lets a fallback backend pick up files
+	// a more specific one chokes on.
+	readers := readersFor(Extension(info.Name()))
+	if len(readers) == 0 {
+		// we have no reader for this file type; ignore it
 		return mf
 	}
 
-	if err := handler(mf); err != nil {
-		return mf
+	for _, r := range readers {
+		if err := r.Inspect(mf); err == nil && mf.Valid {
+			mf.TagReaderName = r.Name()
+			break
+		}
 	}
-	// NB, handler() is expected to have set Valid == true if it worked.
+	// NB, Inspect() is expected to have set Valid == true if it worked.
 
 	fd, err := os.Open(path)
 	if err != nil {
@@ -240,9 +267,62 @@ func NewMasterFile(path string, info os.FileInfo) *MasterFile {
 	}
 	defer fd.Close()
 
+	if mf.Valid {
+		if hash, err := ComputeContentHash(path, info); err == nil {
+			mf.ContentHash = hash
+		}
+		// a failure here just means the encode cache can't recognize this
+		// file; it is not a reason to drop it from the library.
+	}
+
 	return mf
 }
 
+// scanTarget is one file that filepath.Walk found needing inspection,
+// because it's either new or changed since the last scan.
+type scanTarget struct {
+	path    string
+	info    os.FileInfo
+	dbIndex int // index into mdb.MasterFiles, or -1 if this path is new
+}
+
+// inspectBatch runs NewMasterFile over targets using *ScanWorkers goroutines
+// instead of one file at a time, and returns one *MasterFile per target in
+// the same order.  A single ffprobe process can't be handed a batch of
+// unrelated input files and asked to attribute streams/tags back to each
+// one, so "batching" here means running the existing per-file inspectors
+// concurrently rather than forking one process per chunk; on a cold scan of
+// a library with thousands of files, most of the wall-clock time is spent
+// waiting on ffprobe/flac/tag subprocesses, so this still gets most of the
+// available speedup.
+func inspectBatch(targets []scanTarget) []*MasterFile {
+	workers := *ScanWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]*MasterFile, len(targets))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = NewMasterFile(targets[i].path, targets[i].info)
+			}
+		}()
+	}
+	for i := range targets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
 // ScanFiles() walks the file tree from mdb.FileRoot, and updates mdb to match
 // whatever it finds.  The result is the same whether you are "updating" an
 // existing MediaDB or an empty one.  The only difference is the messages
@@ -255,6 +335,8 @@ func ScanFiles(mdb *MediaDB, msgs io.Writer) error {
 		mdb.MasterFiles[i].Valid = false
 	}
 
+	var targets []scanTarget
+
 	err := filepath.Walk(mdb.FileRoot,
 		func(path string, info os.FileInfo, err error) error {
 
@@ -273,22 +355,11 @@ func ScanFiles(mdb *MediaDB, msgs io.Writer) error {
 				return nil
 			}
 
-			mf := NewMasterFile(path, info)
-			if mf == nil {
-				return nil
-			} else if mf.Valid == false {
-				fmt.Fprintf(msgs, "invalid file: %v\n", path)
-				return nil
-			}
-
+			dbIndex := -1
 			if ok {
-				fmt.Fprintf(msgs, "changed file: %v\n", path)
-				mdb.MasterFiles[i] = *mf
-			} else {
-				fmt.Fprintf(msgs, "new file: %v\n", path)
-				mf.Valid = true
-				mdb.MasterFiles = append(mdb.MasterFiles, *mf)
+				dbIndex = i
 			}
+			targets = append(targets, scanTarget{path, info, dbIndex})
 
 			return nil
 		})
@@ -297,6 +368,25 @@ func ScanFiles(mdb *MediaDB, msgs io.Writer) error {
 		return err
 	}
 
+	for i, mf := range inspectBatch(targets) {
+		target := targets[i]
+		if mf == nil {
+			continue
+		} else if mf.Valid == false {
+			fmt.Fprintf(msgs, "invalid file: %v\n", target.path)
+			continue
+		}
+
+		if target.dbIndex >= 0 {
+			fmt.Fprintf(msgs, "changed file: %v\n", target.path)
+			mdb.MasterFiles[target.dbIndex] = *mf
+		} else {
+			fmt.Fprintf(msgs, "new file: %v\n", target.path)
+			mf.Valid = true
+			mdb.MasterFiles = append(mdb.MasterFiles, *mf)
+		}
+	}
+
 	for i := range mdb.MasterFiles {
 		if !mdb.MasterFiles[i].Valid {
 			fmt.Fprintf(msgs, "deleted file: %v\n", mdb.MasterFiles[i].Path)
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+func init() {
+	RegisterTagReader(exiftoolReader{})
+}
+
+// exiftoolShape is the subset of `exiftool -j` output we care about.  Most
+// fields are absent on plain photos, which is fine.
+type exiftoolShape struct {
+	Title      string `json:"Title"`
+	DateCreate string `json:"DateTimeOriginal"`
+}
+
+// exiftoolReader shells out to exiftool for image and sidecar files, which
+// carry metadata in formats (EXIF, XMP, IPTC) none of the audio/video
+// readers understand.
+type exiftoolReader struct{}
+
+func (exiftoolReader) Name() string { return "exiftool" }
+func (exiftoolReader) Extensions() []string {
+	return []string{"jpg", "jpeg", "png", "nfo"}
+}
+
+func (exiftoolReader) Inspect(mf *MasterFile) error {
+
+	mf.Type = Image
+
+	out, err := exec.Command("exiftool", "-j", mf.Path).Output()
+	if err != nil {
+		return fmt.Errorf("exiftool: %v", err)
+	}
+
+	var shapes []exiftoolShape
+	if err := json.Unmarshal(out, &shapes); err != nil {
+		return err
+	}
+	if len(shapes) == 0 {
+		return fmt.Errorf("exiftool returned no metadata for %v", mf.Path)
+	}
+
+	if len(shapes[0].Title) > 0 {
+		mf.Title = []string{shapes[0].Title}
+	}
+	mf.Date = shapes[0].DateCreate
+
+	// images don't have a "title" tag the way audio does; treat the mere
+	// presence of a parseable file as valid so sidecar art gets tracked.
+	mf.Valid = true
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// FuzzInspectMp3 feeds arbitrary bytes to inspectMp3 as if they were an mp3
+// file, since dhowden/tag is known to panic on malformed input (hence the
+// recover() in inspectMp3).  The invariant is: no panic escapes, and
+// mf.Valid is only ever true when mf.Title[0] is non-empty.
+func FuzzInspectMp3(f *testing.F) {
+	seeds := [][]byte{
+		{},
+		[]byte("not an mp3 at all"),
+		[]byte("ID3"),
+		append([]byte("ID3\x03\x00\x00\x00\x00\x00\x00"), make([]byte, 16)...),
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "fuzz.mp3")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("failed to write temp file: %v", err)
+		}
+
+		mf := &MasterFile{Path: path}
+		inspectMp3(mf) // error return is uninteresting; panics are the bug
+
+		if mf.Valid && (len(mf.Title) == 0 || mf.Title[0] == "") {
+			t.Fatalf("inspectMp3(%q): Valid=true with no title", data)
+		}
+	})
+}
+
+// FuzzInspectMpeg feeds arbitrary bytes to parseFfprobeOutput as if they
+// were ffprobe's -print_format json output, so the JSON decoder and the
+// field-by-field extraction that follows it get exercised without needing
+// a real ffprobe to produce the input.  The invariant is: no panic, and
+// mf.Valid is only ever true when both Title and Stream are non-empty.
+func FuzzInspectMpeg(f *testing.F) {
+	seeds := []string{
+		``,
+		`{}`,
+		`{"streams":[{"codec_type":"video"}]}`,
+		`{"streams":[{"codec_type":"audio","bit_rate":"not a number"}],` +
+			`"format":{"tags":{"title":"x"}}}`,
+		`{"streams":null,"format":null,"chapters":null}`,
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, data string) {
+		mf := &MasterFile{}
+		parseFfprobeOutput([]byte(data), mf) // error is uninteresting here
+
+		if mf.Valid && (len(mf.Title) == 0 || mf.Title[0] == "" || len(mf.Stream) == 0) {
+			t.Fatalf("parseFfprobeOutput(%q): Valid=true with no title or stream", data)
+		}
+	})
+}
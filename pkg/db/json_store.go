@@ -0,0 +1,99 @@
+package db
+
+import (
+	"os"
+	"sort"
+)
+
+// jsonStore adapts the original whole-file MediaDB to the Store interface.
+// Every mutation rewrites the entire file; this is fine for the library
+// sizes mtool has historically been used on, and is kept as the default so
+// existing ~/.mtooldb files keep working without migration.
+type jsonStore struct {
+	path string
+	mdb  MediaDB
+}
+
+func openJsonStore(path string) (Store, error) {
+	s := &jsonStore{path: path}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return s, nil
+	}
+	mdb, err := LoadDb()
+	if err != nil {
+		return nil, err
+	}
+	s.mdb = mdb
+	return s, nil
+}
+
+func (s *jsonStore) flush() error {
+	return SaveDb(s.mdb)
+}
+
+func (s *jsonStore) Get(path string) (*MasterFile, bool, error) {
+	for i := range s.mdb.MasterFiles {
+		if s.mdb.MasterFiles[i].Path == path {
+			return &s.mdb.MasterFiles[i], true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (s *jsonStore) Put(mf MasterFile) error {
+	for i := range s.mdb.MasterFiles {
+		if s.mdb.MasterFiles[i].Path == mf.Path {
+			s.mdb.MasterFiles[i] = mf
+			return s.flush()
+		}
+	}
+	s.mdb.MasterFiles = append(s.mdb.MasterFiles, mf)
+	return s.flush()
+}
+
+func (s *jsonStore) Delete(path string) error {
+	for i := range s.mdb.MasterFiles {
+		if s.mdb.MasterFiles[i].Path == path {
+			s.mdb.MasterFiles = append(
+				s.mdb.MasterFiles[:i], s.mdb.MasterFiles[i+1:]...)
+			return s.flush()
+		}
+	}
+	return nil
+}
+
+func (s *jsonStore) Iter() ([]MasterFile, error) {
+	return s.mdb.MasterFiles, nil
+}
+
+func (s *jsonStore) Search(re string) ([]string, error) {
+	return s.mdb.RegexSearch(re)
+}
+
+func (s *jsonStore) FileRoot() (string, error) {
+	return s.mdb.FileRoot, nil
+}
+
+func (s *jsonStore) SetFileRoot(path string) error {
+	s.mdb.FileRoot = path
+	return s.flush()
+}
+
+func (s *jsonStore) Latest(n int) ([]string, error) {
+	files := append([]MasterFile{}, s.mdb.MasterFiles...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Mtime.Unix() > files[j].Mtime.Unix()
+	})
+	if n > len(files) {
+		n = len(files)
+	}
+	paths := make([]string, n)
+	for i := 0; i < n; i++ {
+		paths[i] = files[i].Path
+	}
+	return paths, nil
+}
+
+func (s *jsonStore) Close() error {
+	return s.flush()
+}
@@ -9,6 +9,22 @@ import (
 	"github.com/dhowden/tag"
 )
 
+func init() {
+	RegisterTagReader(dhowdenReader{})
+}
+
+// dhowdenReader reads tags with the pure-Go dhowden/tag library.  It covers
+// mp3, m4a and ogg reasonably well without needing cgo, but is prone to
+// panicking on malformed files, hence the recover() in inspectMp3.  For
+// formats dhowden/tag doesn't know (opus, wav, wma, ...) see taglibReader.
+type dhowdenReader struct{}
+
+func (dhowdenReader) Name() string         { return "dhowden/tag" }
+func (dhowdenReader) Extensions() []string { return []string{"mp3", "m4a", "ogg"} }
+func (dhowdenReader) Inspect(mf *MasterFile) error {
+	return inspectMp3(mf)
+}
+
 // trim() drops any leading or trailing garbage that is either Unicode
 // "white space" or byte 0x00.  You get a ton of this; apparently there
 // have been a lot of crappy tag editors in history.
@@ -48,7 +64,9 @@ func inspectMp3(mf *MasterFile) error {
 	mf.Artist = trim(md.Artist())
 	mf.Album = trim(md.Album())
 	mf.TrackNum, mf.TrackMax = md.Track()
-	mf.Valid = true
+	if len(mf.Title[0]) > 0 {
+		mf.Valid = true
+	}
 
 	return nil
 }
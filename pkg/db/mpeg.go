@@ -1,80 +1,181 @@
 package db
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
 	"os/exec"
-	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 )
 
-var streamRegex = regexp.MustCompile(
-	`Stream #0:(\d+).*?\((\w+)\): (Audio|Video|Subtitle): (\w+)(?:.*?(\d+) kb/s)?`)
-var metadataRegex = regexp.MustCompile(
-	`(title|show|episode_id|date) +: (.*)`)
+func init() {
+	RegisterTagReader(ffprobeReader{})
+}
+
+// ffprobeReader shells out to ffprobe and decodes its structured JSON output.
+// It is the only backend that understands video containers.
+type ffprobeReader struct{}
+
+func (ffprobeReader) Name() string         { return "ffprobe" }
+func (ffprobeReader) Extensions() []string { return []string{"mkv", "mp4"} }
+func (ffprobeReader) Inspect(mf *MasterFile) error {
+	return inspectMpeg(mf)
+}
+
+// the shapes below mirror only the fields of ffprobe's -print_format json
+// output that we care about; everything else is silently dropped by the
+// decoder.
+
+type ffprobeDisposition struct {
+	Default int `json:"default"`
+	Forced  int `json:"forced"`
+}
+
+type ffprobeStream struct {
+	Index         int                `json:"index"`
+	CodecName     string             `json:"codec_name"`
+	CodecLongName string             `json:"codec_long_name"`
+	CodecType     string             `json:"codec_type"`
+	SampleRate    string             `json:"sample_rate"`
+	Channels      int                `json:"channels"`
+	ChannelLayout string             `json:"channel_layout"`
+	Width         int                `json:"width"`
+	Height        int                `json:"height"`
+	RFrameRate    string             `json:"r_frame_rate"`
+	BitRate       string             `json:"bit_rate"`
+	Disposition   ffprobeDisposition `json:"disposition"`
+	Tags          map[string]string  `json:"tags"`
+}
+
+type ffprobeChapter struct {
+	StartTime string            `json:"start_time"`
+	EndTime   string            `json:"end_time"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type ffprobeFormat struct {
+	Tags map[string]string `json:"tags"`
+}
+
+type ffprobeOutput struct {
+	Streams  []ffprobeStream  `json:"streams"`
+	Format   ffprobeFormat    `json:"format"`
+	Chapters []ffprobeChapter `json:"chapters"`
+}
+
+// tagLookup returns tags[key], trying both the given case and lowercase,
+// because matroska and mp4 containers don't agree on tag casing
+// (e.g. "Language" vs "language").
+func tagLookup(tags map[string]string, key string) string {
+	if v, ok := tags[key]; ok {
+		return v
+	}
+	return tags[strings.ToLower(key)]
+}
 
 func inspectMpeg(mf *MasterFile) error {
 
 	mf.Type = Video
 
-	cmd := exec.Command("ffprobe", mf.Path)
-	stderr, err := cmd.StderrPipe()
+	out, err := exec.Command("ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format", "-show_streams", "-show_chapters",
+		mf.Path).Output()
 	if err != nil {
+		fmt.Printf("failed to run ffprobe %v\n", mf.Path)
+		fmt.Println(err)
 		return err
 	}
-	scanner := bufio.NewScanner(stderr)
 
-	if err := cmd.Start(); err != nil {
-		fmt.Printf("failed to run ffprobe %v\n", mf.Path)
-		fmt.Println(err)
+	if err := parseFfprobeOutput(out, mf); err != nil {
+		return fmt.Errorf("unparseable ffprobe output for %v: %v", mf.Path, err)
+	}
+	return nil
+}
+
+// parseFfprobeOutput decodes out (the JSON that "ffprobe -print_format
+// json" writes to stdout) and fills in mf.  It never panics, even on
+// arbitrary or truncated input, which is what lets FuzzInspectMpeg drive it
+// directly with bytes that were never near a real ffprobe.
+func parseFfprobeOutput(out []byte, mf *MasterFile) error {
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(out, &probe); err != nil {
 		return err
 	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if m := streamRegex.FindStringSubmatch(line); m != nil {
-			// verify that stream number matches what we expect
-			index, err := strconv.Atoi(m[1])
-			if err != nil || index != len(mf.Stream) {
-				fmt.Printf("bad stream number: got %v expected %v\n",
-					index, len(mf.Stream))
-				panic("unpossible or out-of-order stream number!")
-			}
-
-			// parse stream type
-			stype, ok := map[string]MediaType{
-				"Audio":    Audio,
-				"Video":    Video,
-				"Subtitle": Subtitle,
-			}[m[3]]
-			if !ok {
-				// you should never get here, because the regex should have only
-				// selected a string present in the map.
-				panic(fmt.Sprintf("unpossible stream type %v!", m[3]))
-			}
-
-			// parse bitrate
-			bitrate, err := strconv.Atoi(m[5])
-			if err != nil {
-				bitrate = 0
-			}
-
-			sd := MpegStreamDesc{stype, m[4], m[2], bitrate}
-			mf.Stream = append(mf.Stream, sd)
-
-		} else if m := metadataRegex.FindStringSubmatch(line); m != nil {
-			switch m[1] {
-			case "title":
-				mf.Title = append(mf.Title, m[2])
-			case "show":
-				mf.Show = m[2]
-			case "episode_id":
-				mf.Episode = m[2]
-			case "date":
-				mf.Date = m[2]
-			default:
-				panic("unpossible metadata tag!")
-			}
+	for _, s := range probe.Streams {
+		stype, ok := map[string]MediaType{
+			"audio":    Audio,
+			"video":    Video,
+			"subtitle": Subtitle,
+		}[s.CodecType]
+		if !ok {
+			// data/attachment streams (e.g. embedded fonts) aren't media
+			// streams we care about.
+			continue
+		}
+
+		bitrate, _ := strconv.Atoi(s.BitRate)
+		sampleRate, _ := strconv.Atoi(s.SampleRate)
+
+		sd := MpegStreamDesc{
+			Type:          stype,
+			Codec:         s.CodecName,
+			CodecLongName: s.CodecLongName,
+			Language:      tagLookup(s.Tags, "language"),
+			Bitrate:       bitrate,
+			SampleRate:    sampleRate,
+			Channels:      s.Channels,
+			ChannelLayout: s.ChannelLayout,
+			Width:         s.Width,
+			Height:        s.Height,
+			FrameRate:     s.RFrameRate,
+			Default:       s.Disposition.Default != 0,
+			Forced:        s.Disposition.Forced != 0,
+		}
+		mf.Stream = append(mf.Stream, sd)
+
+		if title := tagLookup(s.Tags, "title"); len(title) > 0 && stype == Video {
+			mf.Title = append(mf.Title, title)
+		}
+	}
+
+	for _, c := range probe.Chapters {
+		start, _ := strconv.ParseFloat(c.StartTime, 64)
+		end, _ := strconv.ParseFloat(c.EndTime, 64)
+		mf.Chapters = append(mf.Chapters, MpegChapter{
+			Title: tagLookup(c.Tags, "title"),
+			Start: start,
+			End:   end,
+		})
+	}
+
+	tags := probe.Format.Tags
+	if title := tagLookup(tags, "title"); len(title) > 0 {
+		mf.Title = append(mf.Title, title)
+	}
+	if show := tagLookup(tags, "show"); len(show) > 0 {
+		mf.Show = show
+	}
+	if episode := tagLookup(tags, "episode_id"); len(episode) > 0 {
+		mf.Episode = episode
+	}
+	if date := tagLookup(tags, "date"); len(date) > 0 {
+		mf.Date = date
+	}
+	if artist := tagLookup(tags, "album_artist"); len(artist) > 0 {
+		mf.Artist = artist
+	} else if artist := tagLookup(tags, "artist"); len(artist) > 0 {
+		mf.Artist = artist
+	}
+	if track := tagLookup(tags, "track"); len(track) > 0 {
+		// ffprobe reports "track" as e.g. "3/12"
+		n, _, _ := strings.Cut(track, "/")
+		if num, err := strconv.Atoi(n); err == nil {
+			mf.TrackNum = num
 		}
 	}
 
@@ -86,5 +187,34 @@ func inspectMpeg(mf *MasterFile) error {
 		mf.Valid = true
 	}
 
-	return cmd.Wait()
+	return nil
+}
+
+var (
+	probeVersionsOnce sync.Once
+	FfprobeVersion    string
+	FfmpegVersion     string
+)
+
+// firstLine runs name with a -version flag and returns the first line of its
+// output, which for both ffprobe and ffmpeg is a one-line self-identification
+// like "ffprobe version 5.1.2-...".
+func firstLine(name string, args ...string) string {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "not found"
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line)
+}
+
+// ProbeVersions detects the ffprobe and ffmpeg versions on $PATH, caching the
+// result, so that the info command can report what this tool is actually
+// shelling out to.
+func ProbeVersions() (ffprobe, ffmpeg string) {
+	probeVersionsOnce.Do(func() {
+		FfprobeVersion = firstLine("ffprobe", "-version")
+		FfmpegVersion = firstLine("ffmpeg", "-version")
+	})
+	return FfprobeVersion, FfmpegVersion
 }
@@ -0,0 +1,317 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func unixToTime(sec int64) time.Time {
+	return time.Unix(sec, 0)
+}
+
+// sqliteStore is the Store implementation for libraries too large to
+// comfortably rewrite as one JSON file on every change.  It keeps one row
+// per MasterFile in master_files, and a separate streams table (so a video
+// file's several audio/subtitle streams don't have to be shoehorned into
+// columns); everything that doesn't have its own column (Title, which can
+// repeat, and Chapters) is stored as a JSON text blob, the same way the
+// whole file is encoded today -- this isn't a "proper" normalized schema,
+// just enough structure to index on path and mtime and push Latest into SQL.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS master_files (
+	path TEXT PRIMARY KEY,
+	type INTEGER,
+	title_json TEXT,
+	date TEXT,
+	mtime INTEGER,
+	has_picture INTEGER,
+	artist TEXT,
+	album TEXT,
+	track_num INTEGER,
+	track_max INTEGER,
+	show TEXT,
+	episode TEXT,
+	content_hash TEXT,
+	chapters_json TEXT,
+	tag_reader_name TEXT
+);
+CREATE INDEX IF NOT EXISTS master_files_mtime ON master_files(mtime);
+CREATE TABLE IF NOT EXISTS meta (
+	key TEXT PRIMARY KEY,
+	value TEXT
+);
+CREATE TABLE IF NOT EXISTS streams (
+	master_path TEXT NOT NULL REFERENCES master_files(path) ON DELETE CASCADE,
+	stream_index INTEGER,
+	type INTEGER,
+	codec TEXT,
+	codec_long_name TEXT,
+	language TEXT,
+	bitrate INTEGER,
+	sample_rate INTEGER,
+	channels INTEGER,
+	channel_layout TEXT,
+	width INTEGER,
+	height INTEGER,
+	frame_rate TEXT,
+	is_default INTEGER,
+	forced INTEGER
+);
+`
+
+func openSqliteStore(path string) (Store, error) {
+	sdb, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sdb.Exec(sqliteSchema); err != nil {
+		sdb.Close()
+		return nil, fmt.Errorf("failed to create schema: %v", err)
+	}
+	return &sqliteStore{db: sdb}, nil
+}
+
+func (s *sqliteStore) Get(path string) (*MasterFile, bool, error) {
+	row := s.db.QueryRow(`SELECT path, type, title_json, date, mtime,
+		has_picture, artist, album, track_num, track_max, show, episode,
+		content_hash, chapters_json, tag_reader_name
+		FROM master_files WHERE path = ?`, path)
+	mf, err := scanMasterFile(row)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	mf.Stream, err = s.streamsFor(path)
+	return mf, true, err
+}
+
+func (s *sqliteStore) streamsFor(path string) ([]MpegStreamDesc, error) {
+	rows, err := s.db.Query(`SELECT type, codec, codec_long_name, language,
+		bitrate, sample_rate, channels, channel_layout, width, height,
+		frame_rate, is_default, forced FROM streams
+		WHERE master_path = ? ORDER BY stream_index`, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var streams []MpegStreamDesc
+	for rows.Next() {
+		var sd MpegStreamDesc
+		var isDefault, forced int
+		if err := rows.Scan(&sd.Type, &sd.Codec, &sd.CodecLongName,
+			&sd.Language, &sd.Bitrate, &sd.SampleRate, &sd.Channels,
+			&sd.ChannelLayout, &sd.Width, &sd.Height, &sd.FrameRate,
+			&isDefault, &forced); err != nil {
+			return nil, err
+		}
+		sd.Default = isDefault != 0
+		sd.Forced = forced != 0
+		streams = append(streams, sd)
+	}
+	return streams, rows.Err()
+}
+
+type scannable interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMasterFile(row scannable) (*MasterFile, error) {
+	var mf MasterFile
+	var titleJson, chaptersJson string
+	var hasPicture int
+	var mtimeUnix int64
+	if err := row.Scan(&mf.Path, &mf.Type, &titleJson, &mf.Date, &mtimeUnix,
+		&hasPicture, &mf.Artist, &mf.Album, &mf.TrackNum, &mf.TrackMax,
+		&mf.Show, &mf.Episode, &mf.ContentHash, &chaptersJson,
+		&mf.TagReaderName); err != nil {
+		return nil, err
+	}
+	mf.Mtime = unixToTime(mtimeUnix)
+	mf.HasPicture = hasPicture != 0
+	mf.Valid = true
+	if len(titleJson) > 0 {
+		if err := json.Unmarshal([]byte(titleJson), &mf.Title); err != nil {
+			return nil, err
+		}
+	}
+	if len(chaptersJson) > 0 {
+		if err := json.Unmarshal([]byte(chaptersJson), &mf.Chapters); err != nil {
+			return nil, err
+		}
+	}
+	return &mf, nil
+}
+
+func (s *sqliteStore) Put(mf MasterFile) error {
+	titleJson, err := json.Marshal(mf.Title)
+	if err != nil {
+		return err
+	}
+	chaptersJson, err := json.Marshal(mf.Chapters)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO master_files (path, type, title_json,
+		date, mtime, has_picture, artist, album, track_num, track_max,
+		show, episode, content_hash, chapters_json, tag_reader_name)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+		ON CONFLICT(path) DO UPDATE SET
+			type=excluded.type, title_json=excluded.title_json,
+			date=excluded.date, mtime=excluded.mtime,
+			has_picture=excluded.has_picture, artist=excluded.artist,
+			album=excluded.album, track_num=excluded.track_num,
+			track_max=excluded.track_max, show=excluded.show,
+			episode=excluded.episode, content_hash=excluded.content_hash,
+			chapters_json=excluded.chapters_json,
+			tag_reader_name=excluded.tag_reader_name`,
+		mf.Path, mf.Type, string(titleJson), mf.Date, mf.Mtime.Unix(),
+		boolToInt(mf.HasPicture), mf.Artist, mf.Album, mf.TrackNum,
+		mf.TrackMax, mf.Show, mf.Episode, mf.ContentHash, string(chaptersJson),
+		mf.TagReaderName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM streams WHERE master_path = ?`, mf.Path); err != nil {
+		return err
+	}
+	for i, sd := range mf.Stream {
+		_, err := tx.Exec(`INSERT INTO streams (master_path, stream_index,
+			type, codec, codec_long_name, language, bitrate, sample_rate,
+			channels, channel_layout, width, height, frame_rate,
+			is_default, forced) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+			mf.Path, i, sd.Type, sd.Codec, sd.CodecLongName, sd.Language,
+			sd.Bitrate, sd.SampleRate, sd.Channels, sd.ChannelLayout,
+			sd.Width, sd.Height, sd.FrameRate, boolToInt(sd.Default),
+			boolToInt(sd.Forced))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Delete(path string) error {
+	// streams.master_path is declared ON DELETE CASCADE, but SQLite only
+	// honors that per-connection after "PRAGMA foreign_keys = ON", which
+	// modernc.org/sqlite doesn't set by default -- so delete explicitly
+	// instead of relying on it, the same way Put() does before reinserting.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM streams WHERE master_path = ?`, path); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM master_files WHERE path = ?`, path); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Iter() ([]MasterFile, error) {
+	rows, err := s.db.Query(`SELECT path, type, title_json, date, mtime,
+		has_picture, artist, album, track_num, track_max, show, episode,
+		content_hash, chapters_json, tag_reader_name FROM master_files`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []MasterFile
+	for rows.Next() {
+		mf, err := scanMasterFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		mf.Stream, err = s.streamsFor(mf.Path)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *mf)
+	}
+	return out, rows.Err()
+}
+
+// Search falls back to regexp.MatchString in Go rather than pushing down
+// into SQL, because SQLite's built-in REGEXP requires registering a custom
+// function and mtool's regexes are matched against several columns at
+// once (see MediaDB.RegexSearch); Latest is the one that actually benefits
+// from an index.
+func (s *sqliteStore) Search(re string) ([]string, error) {
+	mfs, err := s.Iter()
+	if err != nil {
+		return nil, err
+	}
+	mdb := MediaDB{MasterFiles: mfs}
+	return mdb.RegexSearch(re)
+}
+
+func (s *sqliteStore) Latest(n int) ([]string, error) {
+	rows, err := s.db.Query(
+		`SELECT path FROM master_files ORDER BY mtime DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// FileRoot and SetFileRoot stash the single scan root in the meta table,
+// the same ad-hoc key/value spot any other one-off setting would go, rather
+// than adding a dedicated column to master_files for something that isn't
+// per-file.
+func (s *sqliteStore) FileRoot() (string, error) {
+	var root string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = 'file_root'`).Scan(&root)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return root, err
+}
+
+func (s *sqliteStore) SetFileRoot(path string) error {
+	_, err := s.db.Exec(`INSERT INTO meta (key, value) VALUES ('file_root', ?)
+		ON CONFLICT(key) DO UPDATE SET value=excluded.value`, path)
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
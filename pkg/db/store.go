@@ -0,0 +1,57 @@
+package db
+
+import "flag"
+
+var DbDriver = flag.String("dbdriver", "",
+	"backing store for the media library: \"json\" or \"sqlite\"; "+
+		"empty means guess from -dbfile's extension, defaulting to json")
+
+// Store is the persistence layer underneath a MediaDB.  LoadDb/SaveDb
+// against a single JSON file is the original (and still default)
+// implementation; it rewrites the whole file on every save, which gets
+// slow once a library has many thousands of entries.  OpenStore also
+// supports a SQLite-backed Store (sqliteStore, in sqlite_store.go) for
+// libraries that have outgrown that.
+type Store interface {
+	Get(path string) (*MasterFile, bool, error)
+	Put(mf MasterFile) error
+	Delete(path string) error
+	Iter() ([]MasterFile, error)
+	Search(re string) ([]string, error)
+	Latest(n int) ([]string, error)
+	// FileRoot and SetFileRoot persist the single root path that ScanFiles
+	// walks, so a caller doesn't have to pass it on every invocation.
+	FileRoot() (string, error)
+	SetFileRoot(path string) error
+	Close() error
+}
+
+// driverFor decides which Store implementation to use, given the explicit
+// -dbdriver flag (if set) or else the extension of path.
+func driverFor(path string) string {
+	if *DbDriver != "" {
+		return *DbDriver
+	}
+	switch Extension(path) {
+	case "db", "sqlite", "sqlite3":
+		return "sqlite"
+	default:
+		return "json"
+	}
+}
+
+// OpenStore opens the Store backing *Dbfile, creating it if it doesn't
+// exist yet.  This is the entry point callers should use; LoadDb/SaveDb
+// remain as the whole-file read and write underneath jsonStore.
+func OpenStore() (Store, error) {
+	dbfile, err := ExpandTilde(*Dbfile)
+	if err != nil {
+		return nil, err
+	}
+	switch driverFor(dbfile) {
+	case "sqlite":
+		return openSqliteStore(dbfile)
+	default:
+		return openJsonStore(dbfile)
+	}
+}
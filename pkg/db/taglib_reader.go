@@ -0,0 +1,62 @@
+//go:build taglib
+
+package db
+
+import (
+	"fmt"
+
+	taglib "github.com/wtolson/go-taglib"
+)
+
+func init() {
+	RegisterTagReader(taglibReader{})
+}
+
+// taglibReader wraps the TagLib C++ library via cgo, giving us one backend
+// that understands container formats dhowden/tag and the native flac parser
+// don't: aac, Opus, WAV, WavPack, Musepack, APE and WMA.  It also claims
+// m4a, as a fallback tried after dhowdenReader.  (It also
+// understands Ogg Vorbis, but dhowdenReader already covers that without
+// cgo, so ogg is left off this list to keep readersFor's iteration order
+// meaningful -- the pure-Go backend gets first crack at it.)  It is built
+// behind the "taglib" tag because it requires libtag1-dev (or equivalent)
+// to be installed, which most CI and end-user environments won't have by
+// default.
+type taglibReader struct{}
+
+func (taglibReader) Name() string { return "taglib (cgo)" }
+func (taglibReader) Extensions() []string {
+	return []string{"m4a", "aac", "opus", "wav", "wv", "mpc", "ape", "wma"}
+}
+
+func (taglibReader) Inspect(mf *MasterFile) error {
+
+	f, err := taglib.Read(mf.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch Extension(mf.Path) {
+	case "aac":
+		mf.Type = Audio
+	default:
+		mf.Type = Audio
+	}
+
+	if title := f.Title(); len(title) > 0 {
+		mf.Title = []string{title}
+	}
+	mf.Artist = f.Artist()
+	mf.Album = f.Album()
+	if year := f.Year(); year > 0 {
+		mf.Date = fmt.Sprintf("%v", year)
+	}
+	mf.TrackNum = f.Track()
+
+	if len(mf.Title) > 0 && len(mf.Title[0]) > 0 {
+		mf.Valid = true
+	}
+
+	return nil
+}
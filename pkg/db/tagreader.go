@@ -0,0 +1,59 @@
+package db
+
+// TagReader already gives us pluggable, registry-selected backends
+// (dhowdenReader, flacReader, ffprobeReader, taglibReader, exiftoolReader)
+// without any caller needing to switch on extension. Pulling it out into
+// its own "tagreader" subpackage, as has been proposed, would mean Inspect
+// stops taking a *MasterFile and starts returning a neutral Tags struct
+// instead, since a tagreader subpackage can't import db (db already needs
+// to import it to register backends and populate MasterFile from the
+// result) without an import cycle. That's a real interface change, not
+// just a file move, and nothing here currently needs a backend that
+// doesn't already live in this package, so it's left alone; MasterFile.
+// TagReaderName (set by NewMasterFile) records which backend won, which is
+// the other concrete piece of this that was missing.
+
+// A TagReader knows how to extract metadata for some set of file extensions
+// and populate a MasterFile from it.  Multiple readers may claim the same
+// extension; NewMasterFile tries them in registration order and keeps the
+// first one that succeeds, so a more specific or more capable backend can be
+// registered ahead of a generic fallback.
+type TagReader interface {
+	// Name identifies the backend, e.g. for the "info" command.
+	Name() string
+	// Extensions lists the lower-cased file extensions (without the dot)
+	// this reader claims to handle.
+	Extensions() []string
+	// Inspect populates mf from the file at mf.Path.  It should set
+	// mf.Type and mf.Valid itself; NewMasterFile does not do it.
+	Inspect(mf *MasterFile) error
+}
+
+var tagReaders []TagReader
+
+// RegisterTagReader adds a backend to the registry.  Backends normally call
+// this from an init() function in the file that defines them.
+func RegisterTagReader(r TagReader) {
+	tagReaders = append(tagReaders, r)
+}
+
+// TagReaders returns the currently registered backends, in the order they
+// will be tried.
+func TagReaders() []TagReader {
+	return tagReaders
+}
+
+// readersFor returns the registered readers that claim the given extension,
+// in registration order.
+func readersFor(ext string) []TagReader {
+	var out []TagReader
+	for _, r := range tagReaders {
+		for _, e := range r.Extensions() {
+			if e == ext {
+				out = append(out, r)
+				break
+			}
+		}
+	}
+	return out
+}
@@ -1,6 +1,7 @@
 package xfm
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -10,6 +11,19 @@ import (
 	"github.com/mdickers47/mtool/pkg/db"
 )
 
+func init() {
+	Register(aacTranscoder{})
+}
+
+// aacTranscoder adapts ImageAac/MakeAac to the Transcoder interface.
+type aacTranscoder struct{}
+
+func (aacTranscoder) Name() string                                  { return "aac" }
+func (aacTranscoder) PlanImages(mfs []db.MasterFile) []db.ImageFile { return ImageAac(mfs) }
+func (aacTranscoder) Encode(ctx context.Context, imf db.ImageFile) error {
+	return MakeAac(ctx, imf)
+}
+
 func ImageAac(mfs []db.MasterFile) []db.ImageFile {
 
 	// identical to the opus imager, but files are named 'm4a'
@@ -23,6 +37,7 @@ func ImageAac(mfs []db.MasterFile) []db.ImageFile {
 			var imf db.ImageFile
 			imf.MasterPath = mf.Path
 			imf.MasterMtime = mf.Mtime
+			imf.ContentHash = mf.ContentHash
 			imf.Artist = mf.Artist
 			imf.Title = mf.Title[i]
 			imf.Album = mf.Album
@@ -43,7 +58,7 @@ func ImageAac(mfs []db.MasterFile) []db.ImageFile {
 	return imfs
 }
 
-func MakeAac(imf db.ImageFile) error {
+func MakeAac(ctx context.Context, imf db.ImageFile) error {
 
 	var flacargs []string
 
@@ -71,10 +86,14 @@ func MakeAac(imf db.ImageFile) error {
 	} else {
 		trackarg = strconv.Itoa(imf.Track)
 	}
+	kbps, ok := kbpsFor("aac")
+	if !ok {
+		kbps = "128"
+	}
 	aacargs := []string{
 		"fdkaac",
 		"--silent",
-		"-b128",
+		"-b" + kbps,
 		"--artist", imf.Artist,
 		"--album", imf.Album,
 		"--title", imf.Title,
@@ -84,10 +103,6 @@ func MakeAac(imf db.ImageFile) error {
 	//"--comment", fmt.Sprintf("TRACKNUMBER=%v", imf.Track),
 	//"--padding", "0"}
 
-	// TODO: Don't know how to place cover art in the m4a container
-	// except by using the Nero aac tool that I don't want to deal
-	// with.
-
 	// create path for file to land (or get "exit 1")
 	err := os.MkdirAll(path.Dir(imf.ImagePath), 0755)
 	if err != nil {
@@ -95,8 +110,8 @@ func MakeAac(imf db.ImageFile) error {
 	}
 
 	// hook up pipeline
-	flaccmd := exec.Command(flacargs[0], flacargs[1:]...)
-	aaccmd := exec.Command(aacargs[0], aacargs[1:]...)
+	flaccmd := exec.CommandContext(ctx, flacargs[0], flacargs[1:]...)
+	aaccmd := exec.CommandContext(ctx, aacargs[0], aacargs[1:]...)
 	if aaccmd.Stdin, err = flaccmd.StdoutPipe(); err != nil {
 		return err
 	}
@@ -115,6 +130,20 @@ func MakeAac(imf db.ImageFile) error {
 		return fmt.Errorf("crashed waiting for flac: %v", err)
 	}
 
+	// fdkaac has no option to embed cover art itself, so mux it in as a
+	// second pass with whichever of MP4Box/AtomicParsley is installed.
+	if imf.HasPicture {
+		picPath, cleanup, err := resolvePicture(imf)
+		if err != nil {
+			fmt.Printf("%v: failed to extract cover art: %v\n", imf.ImagePath, err)
+		} else {
+			defer cleanup()
+			if err := muxCoverArt(imf.ImagePath, picPath); err != nil {
+				fmt.Printf("%v: failed to embed cover art: %v\n", imf.ImagePath, err)
+			}
+		}
+	}
+
 	fmt.Printf("created: %v\n", imf.ImagePath)
 	return nil
 }
@@ -0,0 +1,159 @@
+package xfm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+
+	"github.com/mdickers47/mtool/pkg/db"
+)
+
+func init() {
+	Register(alacTranscoder{})
+}
+
+// alacTranscoder adapts ImageAlac/MakeAlac to the Transcoder interface.
+type alacTranscoder struct{}
+
+func (alacTranscoder) Name() string                                  { return "alac" }
+func (alacTranscoder) PlanImages(mfs []db.MasterFile) []db.ImageFile { return ImageAlac(mfs) }
+func (alacTranscoder) Encode(ctx context.Context, imf db.ImageFile) error {
+	return MakeAlac(ctx, imf)
+}
+
+// ImageAlac plans a lossless .m4a (ALAC) image per track, for Apple
+// devices that refuse raw FLAC.
+func ImageAlac(mfs []db.MasterFile) []db.ImageFile {
+
+	// identical to the opus imager, but files are named 'm4a'
+	imfs := make([]db.ImageFile, 0, 100)
+	for _, mf := range mfs {
+		if mf.Type != db.Audio {
+			continue
+		}
+
+		for i := 0; i < len(mf.Title); i++ {
+			var imf db.ImageFile
+			imf.MasterPath = mf.Path
+			imf.MasterMtime = mf.Mtime
+			imf.ContentHash = mf.ContentHash
+			imf.Artist = mf.Artist
+			imf.Title = mf.Title[i]
+			imf.Album = mf.Album
+			imf.Date = mf.Date
+			if mf.TrackNum > 0 {
+				imf.Track = mf.TrackNum
+			} else {
+				imf.Track = i + 1
+			}
+			imf.TrackMax = mf.TrackMax
+			imf.HasPicture = mf.HasPicture
+			imf.ImagePath = fmt.Sprintf("%v/%v/%02d %.32s.m4a",
+				pathSafe(imf.Artist), pathSafe(imf.Album), imf.Track,
+				pathSafe(mf.Title[i]))
+			imfs = append(imfs, imf)
+		}
+	}
+	return imfs
+}
+
+// MakeAlac pipes flac|ffmpeg decode of one track into a second ffmpeg that
+// re-encodes it losslessly as ALAC, the way MakeAac does for fdkaac.
+// Unlike the lossy transcoders, -quality has no effect here: ALAC has no
+// meaningful bitrate knob to tune, so whatever -quality sets for "alac" is
+// ignored.
+func MakeAlac(ctx context.Context, imf db.ImageFile) error {
+
+	var flacargs []string
+
+	if db.Extension(imf.MasterPath) == "flac" {
+		flacargs = []string{
+			"flac",
+			"--silent",
+			"--decode",
+			"--stdout",
+			fmt.Sprintf("--cue=%v.1-%v.1", imf.Track, imf.Track+1),
+			imf.MasterPath}
+	} else {
+		// flacargs is misnamed in any other case .. oh well.
+		flacargs = []string{
+			"ffmpeg",
+			"-i", imf.MasterPath,
+			"-f", "wav",
+			"pipe:",
+		}
+	}
+
+	var trackarg string
+	if imf.TrackMax > 0 {
+		trackarg = fmt.Sprintf("%v/%v", imf.Track, imf.TrackMax)
+	} else {
+		trackarg = strconv.Itoa(imf.Track)
+	}
+
+	ffmpegargs := []string{
+		"ffmpeg",
+		"-y",
+		"-loglevel", "error",
+		"-i", "pipe:",
+	}
+
+	var picPath string
+	if imf.HasPicture {
+		var cleanup func()
+		var err error
+		picPath, cleanup, err = resolvePicture(imf)
+		if err != nil {
+			fmt.Printf("%v: failed to extract cover art: %v\n", imf.ImagePath, err)
+		} else {
+			defer cleanup()
+			ffmpegargs = append(ffmpegargs,
+				"-i", picPath,
+				"-map", "0:a", "-map", "1:v",
+				"-c:v", "copy",
+				"-disposition:v:0", "attached_pic")
+		}
+	}
+
+	ffmpegargs = append(ffmpegargs,
+		"-c:a", "alac",
+		"-movflags", "+faststart",
+		"-metadata", "artist="+imf.Artist,
+		"-metadata", "album="+imf.Album,
+		"-metadata", "title="+imf.Title,
+		"-metadata", "track="+trackarg,
+		imf.ImagePath)
+
+	// create path for file to land (or get "exit 1")
+	err := os.MkdirAll(path.Dir(imf.ImagePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	// hook up pipeline
+	flaccmd := exec.CommandContext(ctx, flacargs[0], flacargs[1:]...)
+	ffmpegcmd := exec.CommandContext(ctx, ffmpegargs[0], ffmpegargs[1:]...)
+	if ffmpegcmd.Stdin, err = flaccmd.StdoutPipe(); err != nil {
+		return err
+	}
+
+	// make it go
+	if err := flaccmd.Start(); err != nil {
+		fmt.Printf("flac %v\n", flacargs)
+		return fmt.Errorf("crashed starting flac: %v", err)
+	}
+	if err := ffmpegcmd.Run(); err != nil {
+		fmt.Printf("ffmpeg %v\n", ffmpegargs)
+		return fmt.Errorf("crashed running ffmpeg: %v", err)
+	}
+	if err := flaccmd.Wait(); err != nil {
+		fmt.Printf("flac %v\n", flacargs)
+		return fmt.Errorf("crashed waiting for flac: %v", err)
+	}
+
+	fmt.Printf("created: %v\n", imf.ImagePath)
+	return nil
+}
@@ -0,0 +1,206 @@
+package xfm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mdickers47/mtool/pkg/db"
+)
+
+var CacheDir = flag.String("cache", "",
+	"content-addressable cache of encoded output, laid out like git's object "+
+		"store; empty disables caching")
+
+// cacheFormatVersion bumps the cache key whenever the encoder args for a
+// transformer change in a way that would make an old cached artifact wrong.
+const cacheFormatVersion = "v1"
+
+// cacheKey identifies one encoded artifact by the content of its source
+// master file, the transformer that produced it, and the cache format
+// version, so a change to this tool's own encoding logic doesn't serve up
+// stale cached output.
+func cacheKey(contentHash, transformer string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v|%v|%v", contentHash, transformer, cacheFormatVersion)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachePath lays keys out the way git does, two levels of subdirectory to
+// keep any one directory from holding too many entries.
+func cachePath(key string) string {
+	return filepath.Join(*CacheDir, key[0:2], key[2:4], key)
+}
+
+// cacheLookup returns the cached artifact's path if key is present.
+func cacheLookup(key string) (string, bool) {
+	p := cachePath(key)
+	if _, err := os.Stat(p); err != nil {
+		return "", false
+	}
+	return p, true
+}
+
+// cacheStore copies (preferring a hard link) the just-made artifact at
+// imagePath into the cache under key, then chmods the cache entry
+// read-only.  A hard link means imagePath and dest are the same inode, so
+// an encoder that later writes imagePath in place (rather than
+// unlink-then-create) would silently corrupt a cache entry keyed for the
+// old content; read-only makes that fail loudly instead.
+func cacheStore(key, imagePath string) error {
+	dest := cachePath(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(imagePath, dest); err != nil {
+		// Link() fails across filesystems; fall back to a copy.
+		if err := copyFile(imagePath, dest); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(dest, 0444)
+}
+
+// cachePopulate hard-links (falling back to a copy) a cached artifact into
+// the destination image path.  imagePath may already exist (a stale output
+// being refreshed from a newly-matching cache entry, possibly itself a
+// hard link to some other cache entry), so it's removed first -- linking
+// or copying on top of it would otherwise silently corrupt whatever inode
+// it used to point at.
+func cachePopulate(cachedPath, imagePath string) error {
+	if err := os.MkdirAll(filepath.Dir(imagePath), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(imagePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(cachedPath, imagePath); err == nil {
+		return nil
+	}
+	return copyFile(cachedPath, imagePath)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// makeWithCache is what MakeImage's workers call instead of xfmr.Encode
+// directly.  With -cache unset it's just xfmr.Encode; with it set, a content
+// hash match means we link in the cached artifact instead of re-encoding,
+// and a fresh encode gets stored in the cache for next time.  ctx is passed
+// straight through to xfmr.Encode so a canceled MakeImage run actually
+// kills the in-flight child process instead of just giving up on waiting
+// for it.
+func makeWithCache(ctx context.Context, xfmr Transcoder, which string, imf db.ImageFile) error {
+	if *CacheDir == "" || imf.ContentHash == "" {
+		return xfmr.Encode(ctx, imf)
+	}
+
+	key := cacheKey(imf.ContentHash, which)
+	if cached, ok := cacheLookup(key); ok {
+		if err := cachePopulate(cached, imf.ImagePath); err == nil {
+			fmt.Printf("cache hit: %v\n", imf.ImagePath)
+			return nil
+		}
+		// fall through and re-encode if the cached copy couldn't be linked
+	}
+
+	// imf.ImagePath may already exist and be hard-linked into the cache
+	// under a different (stale) key -- MakeImage re-encodes in place
+	// whenever the output is merely out of date, not missing.  Encoders
+	// open(O_CREAT|O_TRUNC) rather than unlink-then-create, so writing
+	// through that path would silently corrupt the old cache entry's
+	// content out from under its key.  Unlink first so the encoder always
+	// creates a fresh inode.
+	if err := os.Remove(imf.ImagePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale %v: %v", imf.ImagePath, err)
+	}
+	if err := xfmr.Encode(ctx, imf); err != nil {
+		return err
+	}
+	if err := cacheStore(key, imf.ImagePath); err != nil {
+		fmt.Printf("%v: failed to populate cache: %v\n", imf.ImagePath, err)
+	}
+	return nil
+}
+
+// CachePrune removes cache entries whose artifact hasn't been touched in
+// olderThan, to bound the cache's growth on a library that gets re-encoded
+// with different settings over time.
+func CachePrune(olderThan time.Duration) error {
+	if *CacheDir == "" {
+		return fmt.Errorf("-cache is not set")
+	}
+	cutoff := time.Now().Add(-olderThan)
+	pruned := 0
+	err := filepath.Walk(*CacheDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if info.ModTime().Before(cutoff) {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	fmt.Printf("pruned %v stale cache entries\n", pruned)
+	return err
+}
+
+// CacheVerify walks the cache and reports any entry that is empty or can't
+// be opened.  An entry's content is not checked against its key, so one
+// truncated to a non-zero length by a crash mid-write is not detected.
+func CacheVerify() error {
+	if *CacheDir == "" {
+		return fmt.Errorf("-cache is not set")
+	}
+	checked, bad := 0, 0
+	err := filepath.Walk(*CacheDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		checked++
+		if info.Size() == 0 {
+			fmt.Printf("empty cache entry: %v\n", p)
+			bad++
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			fmt.Printf("unreadable cache entry %v: %v\n", p, err)
+			bad++
+			return nil
+		}
+		f.Close()
+		return nil
+	})
+	fmt.Printf("checked %v cache entries, %v bad\n", checked, bad)
+	return err
+}
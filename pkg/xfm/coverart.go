@@ -0,0 +1,66 @@
+package xfm
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+// muxCoverTool names the external tool used to mux cover art into an m4a
+// container after fdkaac has written it, since fdkaac itself has no option
+// for that.  mp4box is preferred because it can add the artwork in place;
+// atomicparsley needs --overWrite to do the same.
+type muxCoverTool int
+
+const (
+	muxCoverNone muxCoverTool = iota
+	muxCoverMp4box
+	muxCoverAtomicParsley
+)
+
+var (
+	muxCoverProbeOnce sync.Once
+	muxCoverAvailable muxCoverTool
+)
+
+// probeMuxCoverTool detects, once, whether MP4Box or AtomicParsley is on
+// $PATH, logging a single warning if neither is, so MakeAac doesn't print
+// the same warning for every file in a library.
+func probeMuxCoverTool() muxCoverTool {
+	muxCoverProbeOnce.Do(func() {
+		switch {
+		case havePath("MP4Box"):
+			muxCoverAvailable = muxCoverMp4box
+		case havePath("AtomicParsley"):
+			muxCoverAvailable = muxCoverAtomicParsley
+		default:
+			muxCoverAvailable = muxCoverNone
+			fmt.Print("neither MP4Box nor AtomicParsley found on $PATH; " +
+				"m4a output will not carry embedded cover art\n")
+		}
+	})
+	return muxCoverAvailable
+}
+
+func havePath(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// muxCoverArt embeds the image at picPath into the m4a file at imagePath,
+// using whichever of MP4Box/AtomicParsley probeMuxCoverTool found.  It is a
+// silent no-op if neither tool is installed; the warning was already
+// printed once by probeMuxCoverTool.
+func muxCoverArt(imagePath, picPath string) error {
+	switch probeMuxCoverTool() {
+	case muxCoverMp4box:
+		cmd := exec.Command("MP4Box", "-add", picPath+":name=cover", imagePath)
+		return cmd.Run()
+	case muxCoverAtomicParsley:
+		cmd := exec.Command("AtomicParsley", imagePath,
+			"--artwork", picPath, "--overWrite")
+		return cmd.Run()
+	default:
+		return nil
+	}
+}
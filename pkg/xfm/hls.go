@@ -0,0 +1,220 @@
+package xfm
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/mdickers47/mtool/pkg/db"
+)
+
+// hlsRendition describes one rung of the bitrate ladder.
+type hlsRendition struct {
+	Width, Height int
+	VBitrate      string
+	ABitrate      string
+}
+
+// hlsPresets is the table -qualities names are looked up in.  These are
+// rough, conservative numbers for a 16:9 source; there is no attempt to
+// derive them from the source stream's own resolution/bitrate.
+var hlsPresets = map[string]hlsRendition{
+	"360p":  {640, 360, "800k", "96k"},
+	"720p":  {1280, 720, "2800k", "128k"},
+	"1080p": {1920, 1080, "5000k", "160k"},
+}
+
+var Qualities = flag.String("qualities", "360p,720p,1080p",
+	"comma-separated rendition ladder for the hls transformer, names from hlsPresets")
+
+var HlsSegSeconds = flag.Int("hls-time", 6,
+	"target segment length in seconds for the hls transformer")
+
+func parseQualities(spec string) ([]string, []hlsRendition, error) {
+	var names []string
+	var renditions []hlsRendition
+	for _, name := range strings.Split(spec, ",") {
+		r, ok := hlsPresets[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown hls quality %q", name)
+		}
+		names = append(names, name)
+		renditions = append(renditions, r)
+	}
+	return names, renditions, nil
+}
+
+// dropUpscaledRenditions removes ladder rungs taller than the source, so a
+// 480p source doesn't get upscaled into bogus 720p/1080p renditions just
+// because -qualities asked for them.  If srcHeight is unknown (0), the
+// ladder is returned unchanged; if the source is shorter than every
+// requested rendition, the shortest one is kept so the ladder is never
+// empty.
+func dropUpscaledRenditions(names []string, renditions []hlsRendition, srcHeight int) ([]string, []hlsRendition) {
+	if srcHeight <= 0 {
+		return names, renditions
+	}
+
+	var keptNames []string
+	var keptRenditions []hlsRendition
+	shortestIdx := 0
+	for i, r := range renditions {
+		if r.Height <= srcHeight {
+			keptNames = append(keptNames, names[i])
+			keptRenditions = append(keptRenditions, r)
+		}
+		if r.Height < renditions[shortestIdx].Height {
+			shortestIdx = i
+		}
+	}
+	if len(keptRenditions) == 0 {
+		return names[shortestIdx : shortestIdx+1], renditions[shortestIdx : shortestIdx+1]
+	}
+	return keptNames, keptRenditions
+}
+
+func init() {
+	Register(hlsTranscoder{})
+}
+
+// hlsTranscoder adapts ImageHls/MakeHls to the Transcoder interface.
+type hlsTranscoder struct{}
+
+func (hlsTranscoder) Name() string                                  { return "hls" }
+func (hlsTranscoder) PlanImages(mfs []db.MasterFile) []db.ImageFile { return ImageHls(mfs) }
+func (hlsTranscoder) Encode(ctx context.Context, imf db.ImageFile) error {
+	return MakeHls(ctx, imf)
+}
+
+// ImageHls expands one video MasterFile into the one ImageFile that
+// represents its whole HLS package.  ImagePath points at the master
+// playlist, which MakeImage's staleness check treats as the sentinel for
+// the entire package of variant playlists and segments.
+func ImageHls(mfs []db.MasterFile) []db.ImageFile {
+
+	imfs := make([]db.ImageFile, 0, 100)
+	for _, mf := range mfs {
+		if mf.Type != db.Video {
+			continue
+		}
+		var imf db.ImageFile
+		if len(mf.Show) > 0 {
+			imf.ImagePath = fmt.Sprintf("tv/%v/%v %v/master.m3u8",
+				pathSafe(mf.Show), pathSafe(mf.Episode), pathSafe(mf.Title[0]))
+		} else {
+			imf.ImagePath = fmt.Sprintf("movies/%v/%v/master.m3u8",
+				pathSafe(mf.Date), pathSafe(mf.Title[0]))
+		}
+		imf.MasterPath = mf.Path
+		imf.MasterMtime = mf.Mtime
+		imf.ContentHash = mf.ContentHash
+		imf.Date = mf.Date
+		imf.Title = mf.Title[0]
+		imf.Stream = mf.Stream
+
+		imfs = append(imfs, imf)
+	}
+
+	return imfs
+}
+
+// MakeHls runs a single ffmpeg invocation that produces every rendition in
+// *Qualities plus the master.m3u8 that selects among them, using the same
+// language-preference audio track that MakeWebm picks.
+func MakeHls(ctx context.Context, imf db.ImageFile) error {
+
+	names, renditions, err := parseQualities(*Qualities)
+	if err != nil {
+		return err
+	}
+
+	dir := path.Dir(imf.ImagePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create path %v: %v", dir, err)
+	}
+
+	var videoIndex string
+	var srcHeight int
+	for i, sd := range imf.Stream {
+		if sd.Type == db.Video {
+			videoIndex = fmt.Sprintf("%v", i)
+			srcHeight = sd.Height
+			break
+		}
+	}
+	names, renditions = dropUpscaledRenditions(names, renditions, srcHeight)
+
+	audioStreams := sortStreams(imf)
+	if len(audioStreams) == 0 {
+		return fmt.Errorf("no audio streams in %v", imf.MasterPath)
+	}
+	audioIndex := fmt.Sprintf("%v", audioStreams[0])
+
+	// build "[0:v]split=N[v0][v1]...;[v0]scale=w=W:h=H[v0out];..."
+	splitLabels := make([]string, len(renditions))
+	for i := range renditions {
+		splitLabels[i] = fmt.Sprintf("[v%v]", i)
+	}
+	filter := fmt.Sprintf("[0:%v]split=%v%v", videoIndex, len(renditions),
+		strings.Join(splitLabels, ""))
+	for i, r := range renditions {
+		filter += fmt.Sprintf(";[v%v]scale=w=%v:h=%v[v%vout]", i, r.Width, r.Height, i)
+	}
+
+	runHls := func(preArgs []string, vCodec string) error {
+		args := append([]string{}, preArgs...)
+		args = append(args, "-i", imf.MasterPath, "-filter_complex", filter)
+
+		var varStreamMap []string
+		for i, r := range renditions {
+			args = append(args,
+				"-map", fmt.Sprintf("[v%vout]", i),
+				fmt.Sprintf("-c:v:%v", i), vCodec, fmt.Sprintf("-b:v:%v", i), r.VBitrate,
+				"-map", fmt.Sprintf("0:%v", audioIndex),
+				fmt.Sprintf("-c:a:%v", i), "aac", fmt.Sprintf("-b:a:%v", i), r.ABitrate)
+			varStreamMap = append(varStreamMap, fmt.Sprintf("v:%v,a:%v,name:%v", i, i, names[i]))
+		}
+
+		// ffmpeg's hls muxer resolves the master playlist's location from
+		// the literal (unsubstituted) dirname of the output argument, so
+		// %v has to stay in the filename, not the directory -- otherwise
+		// -master_pl_name never lands at dir/master.m3u8, the sentinel
+		// ImageHls's ImagePath points MakeImage's staleness check at.
+		args = append(args,
+			"-var_stream_map", strings.Join(varStreamMap, " "),
+			"-hls_time", fmt.Sprintf("%v", *HlsSegSeconds),
+			"-hls_playlist_type", "vod",
+			"-master_pl_name", "master.m3u8",
+			"-hls_segment_filename", path.Join(dir, "%v_data%03d.ts"),
+			path.Join(dir, "stream_%v.m3u8"))
+
+		cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+		return cmd.Run()
+	}
+
+	// the bitrate ladder is already per-rendition, so hardware acceleration
+	// here only needs to swap the encoder name, not map CRF to a bitrate.
+	hwPreArgs, hwCodecArgs, usedHw := hwH264Args(renditions[0].VBitrate)
+	vCodec := "libx264"
+	if usedHw {
+		vCodec = hwCodecArgs[1] // hwCodecArgs is ["-c:v", <encoder>, "-b:v", ...]
+	}
+
+	if err := runHls(hwPreArgs, vCodec); err != nil {
+		if !usedHw {
+			return fmt.Errorf("crashed running ffmpeg: %v", err)
+		}
+		fmt.Printf("hwaccel encode of %v failed (%v), falling back to software\n",
+			imf.MasterPath, err)
+		if err := runHls(nil, "libx264"); err != nil {
+			return fmt.Errorf("crashed running ffmpeg: %v", err)
+		}
+	}
+
+	fmt.Printf("created: %v\n", imf.ImagePath)
+	return nil
+}
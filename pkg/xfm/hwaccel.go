@@ -0,0 +1,143 @@
+package xfm
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var Hwaccel = flag.String("hwaccel", "none",
+	"hardware video acceleration: none|auto|vaapi|nvenc|qsv|videotoolbox")
+
+// hwEncoderSet names the hardware encoders available under one ffmpeg
+// -hwaccel backend, for the two video codec families mtool produces.
+type hwEncoderSet struct {
+	Vp9  string
+	H264 string
+}
+
+var hwEncodersByAccel = map[string]hwEncoderSet{
+	"vaapi":        {"vp9_vaapi", "h264_vaapi"},
+	"nvenc":        {"hevc_nvenc", "h264_nvenc"}, // nvenc has no usable vp9 encoder
+	"qsv":          {"vp9_qsv", "h264_qsv"},
+	"videotoolbox": {"hevc_videotoolbox", "h264_videotoolbox"}, // no vp9 either
+}
+
+// hwPreArgsByAccel holds the -hwaccel/-hwaccel_output_format/-vf arguments
+// that must appear before -i to get frames onto the device in a format the
+// matching encoder accepts.
+var hwPreArgsByAccel = map[string][]string{
+	"vaapi": {"-hwaccel", "vaapi", "-hwaccel_output_format", "vaapi",
+		"-vf", "format=nv12,hwupload"},
+	"nvenc": {"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"},
+	"qsv": {"-hwaccel", "qsv", "-hwaccel_output_format", "qsv",
+		"-vf", "hwupload=extra_hw_frames=64,format=qsv"},
+	"videotoolbox": {"-hwaccel", "videotoolbox"},
+}
+
+var (
+	probeOnce      sync.Once
+	availableAccel []string
+)
+
+// probeHwaccel runs `ffmpeg -hwaccels` and `-encoders` once and records
+// which of hwEncodersByAccel are actually usable on this machine's ffmpeg.
+func probeHwaccel() {
+	probeOnce.Do(func() {
+		hwOut, _ := exec.Command("ffmpeg", "-hide_banner", "-hwaccels").Output()
+		encOut, _ := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+		hwList := string(hwOut)
+		encList := string(encOut)
+
+		for accel, enc := range hwEncodersByAccel {
+			// -hwaccels lists the -hwaccel name, which isn't always the
+			// backend's own (nvenc runs under "cuda").
+			if !strings.Contains(hwList, hwPreArgsByAccel[accel][1]) {
+				continue
+			}
+			if strings.Contains(encList, enc.Vp9) || strings.Contains(encList, enc.H264) {
+				availableAccel = append(availableAccel, accel)
+			}
+		}
+	})
+}
+
+// chooseHwEncoder resolves *Hwaccel to a concrete backend.  ok is false for
+// "none", for "auto" when nothing usable was found, and for an explicit
+// backend name this ffmpeg doesn't actually support.
+func chooseHwEncoder() (accel string, enc hwEncoderSet, ok bool) {
+	switch *Hwaccel {
+	case "", "none":
+		return "", hwEncoderSet{}, false
+	case "auto":
+		probeHwaccel()
+		// vaapi is the most common on the Linux boxes this tool usually
+		// runs on; nvenc/qsv next, videotoolbox only applies on macOS.
+		for _, pref := range []string{"vaapi", "nvenc", "qsv", "videotoolbox"} {
+			for _, a := range availableAccel {
+				if a == pref {
+					return pref, hwEncodersByAccel[pref], true
+				}
+			}
+		}
+		return "", hwEncoderSet{}, false
+	default:
+		enc, ok := hwEncodersByAccel[*Hwaccel]
+		if !ok {
+			return "", hwEncoderSet{}, false
+		}
+		probeHwaccel()
+		for _, a := range availableAccel {
+			if a == *Hwaccel {
+				return *Hwaccel, enc, true
+			}
+		}
+		return "", hwEncoderSet{}, false
+	}
+}
+
+// crfToBitrate maps libvpx-vp9's CRF scale onto a constant bitrate, since
+// none of the hardware VP9/HEVC encoders support true constant-quality mode.
+// It is a coarse heuristic, not a calibrated curve.
+func crfToBitrate(crf int) string {
+	switch {
+	case crf <= 20:
+		return "8M"
+	case crf <= 28:
+		return "5M"
+	case crf <= 35:
+		return "3M"
+	default:
+		return "1500k"
+	}
+}
+
+func softwareVp9Args(crf int) []string {
+	return []string{"-c:v", "libvpx-vp9", "-crf", fmt.Sprintf("%v", crf), "-b:v", "0"}
+}
+
+// hwVideoArgs returns the pre-input hwaccel args and the video codec args
+// for a vp9-family encode at the given CRF, preferring hardware per
+// *Hwaccel.  usedHw tells the caller whether a software fallback is worth
+// retrying on failure.
+func hwVideoArgs(crf int) (preArgs []string, codecArgs []string, usedHw bool) {
+	accel, enc, ok := chooseHwEncoder()
+	if !ok {
+		return nil, softwareVp9Args(crf), false
+	}
+	fmt.Printf("using hwaccel backend: %v (%v)\n", accel, enc.Vp9)
+	return hwPreArgsByAccel[accel], []string{"-c:v", enc.Vp9, "-b:v", crfToBitrate(crf)}, true
+}
+
+// hwH264Args is the h264-family equivalent of hwVideoArgs, used by the hls
+// transformer's bitrate ladder, where the target bitrate is already known
+// per rendition.
+func hwH264Args(bitrate string) (preArgs []string, codecArgs []string, usedHw bool) {
+	accel, enc, ok := chooseHwEncoder()
+	if !ok {
+		return nil, []string{"-c:v", "libx264", "-b:v", bitrate}, false
+	}
+	return hwPreArgsByAccel[accel], []string{"-c:v", enc.H264, "-b:v", bitrate}, true
+}
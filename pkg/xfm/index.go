@@ -1,49 +1,70 @@
 package xfm
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/dhowden/tag"
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/sync/errgroup"
+
 	"github.com/mdickers47/mtool/pkg/db"
 )
 
 var Parallelism = flag.Int("j", 1, "how many make threads to run in parallel")
 
-type Transformer struct {
-	Image func([]db.MasterFile) []db.ImageFile
-	Make  func(db.ImageFile) error
-}
-
-var Byname = map[string]Transformer{
-	"opus": Transformer{ImageOpus, MakeOpus},
-	"webm": Transformer{ImageWebm, MakeWebm},
-	"aac":  Transformer{ImageAac, MakeAac},
-	"mp3":  Transformer{ImageMp3, MakeMp3},
+var RetryFailed = flag.Bool("retry-failed", false,
+	"retry image files recorded in .mtool-skip from a previous failed run, "+
+		"instead of skipping them")
+
+// Progress describes the outcome of one job in a MakeImage run, for a
+// caller that wants to draw a progress bar or ETA instead of just waiting
+// for the final error.
+type Progress struct {
+	ImagePath string
+	Done      int
+	Total     int
+	Duration  time.Duration
+	Err       error
 }
 
-func MakeImage(mdb *db.MediaDB, which string, root string) error {
-
-	xfmr, ok := Byname[which]
+// ProgressFunc receives one Progress record per completed job.  It may be
+// called from multiple goroutines concurrently.
+type ProgressFunc func(Progress)
+
+// MakeImage plans and encodes every out-of-date image file for which in
+// mdb, writing output under root.  Jobs run *Parallelism at a time via an
+// errgroup rather than a raw channel+WaitGroup, so canceling ctx (e.g. on
+// SIGINT) stops dispatching new jobs and the partially-written output of
+// any in-flight job is removed instead of left truncated.  Per-file errors
+// no longer go straight to stdout: they are reported one at a time to
+// progress (which may be nil) and aggregated into the returned
+// multierror.Error, and the failing ImagePath is recorded in root's
+// .mtool-skip file so a re-run doesn't retry the same poison input unless
+// -retry-failed is given.
+func MakeImage(ctx context.Context, mdb *db.MediaDB, which string, root string, progress ProgressFunc) error {
+
+	xfmr, ok := transcoders[which]
 	if !ok {
 		return fmt.Errorf("invalid transform type: %v", which)
 	}
 
-	if len(which) == 0 {
+	if len(root) == 0 {
 		return fmt.Errorf("output path must be specified")
 	}
-	which, err := db.ExpandTilde(which)
+	root, err := db.ExpandTilde(root)
 	if err != nil {
 		return err
 	}
 
-	imfs := xfmr.Image(mdb.MasterFiles)
+	imfs := xfmr.PlanImages(mdb.MasterFiles)
 	fmt.Printf("master files: %v image files: %v\n",
 		len(mdb.MasterFiles), len(imfs))
 
@@ -62,57 +83,80 @@ func MakeImage(mdb *db.MediaDB, which string, root string) error {
 		}
 	}
 
+	skipped, err := loadSkipList(root)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", skipListName, err)
+	}
+	if !*RetryFailed && len(skipped) > 0 {
+		filtered := keep_imfs[:0]
+		for _, imf := range keep_imfs {
+			if !skipped[imf.ImagePath] {
+				filtered = append(filtered, imf)
+			}
+		}
+		if n := len(keep_imfs) - len(filtered); n > 0 {
+			fmt.Printf("%v image files skipped (previously failed; "+
+				"rerun with -retry-failed to retry)\n", n)
+		}
+		keep_imfs = filtered
+	}
+
 	fmt.Printf("%v image files present, %v to make\n",
 		len(imfs)-len(keep_imfs), len(keep_imfs))
 
-	imfchan := make(chan db.ImageFile)
-	var wg sync.WaitGroup
-	wg.Add(*Parallelism)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(*Parallelism)
+
+	var (
+		mu   sync.Mutex
+		errs *multierror.Error
+		done int
+	)
+	total := len(keep_imfs)
+
+	for _, imf := range keep_imfs {
+		imf := imf
+		if gctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			start := time.Now()
+			err := makeWithCache(gctx, xfmr, which, imf)
+			if err != nil && gctx.Err() != nil {
+				// canceled mid-encode: don't leave a truncated file behind
+				os.Remove(imf.ImagePath)
+			}
 
-	for i := 0; i < *Parallelism; i++ {
-		go func() {
-			defer wg.Done()
-			for imf := range imfchan {
-				if err := xfmr.Make(imf); err != nil {
-					fmt.Printf("%v: %v\n", imf.ImagePath, err)
+			mu.Lock()
+			done++
+			p := Progress{ImagePath: imf.ImagePath, Done: done, Total: total,
+				Duration: time.Since(start), Err: err}
+			if err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("%v: %v", imf.ImagePath, err))
+				if skipErr := appendSkipList(root, imf.ImagePath); skipErr != nil {
+					fmt.Printf("failed to update %v: %v\n", skipListName, skipErr)
 				}
 			}
-		}()
-	}
-	for _, imf := range keep_imfs {
-		imfchan <- imf
+			mu.Unlock()
+
+			if progress != nil {
+				progress(p)
+			}
+			// a per-file failure doesn't cancel the other jobs; only ctx
+			// canceling (or errgroup's own bookkeeping) does that.
+			return nil
+		})
 	}
-	close(imfchan)
-	wg.Wait()
+	g.Wait()
 
+	if errs != nil {
+		return errs
+	}
 	return nil
 }
 
 // utilities that are used by more than one xfm module
 
-func pathSafe(instr string) string {
-
-	nerf := func(r rune) rune {
-		switch r {
-		case '?', '*', '"', '\'', '!', '<', '>', '(', ')':
-			return -1 // this means 'delete' to strings.Map()
-		case '/', '\\', ':', '#':
-			return '-'
-		case '&':
-			return '+'
-		default:
-			return r
-		}
-	}
-
-	outstr := strings.Map(nerf, instr)
-	if len(outstr) == 0 {
-		outstr = "null"
-	}
-	return outstr
-
-}
-
 func getPicture(path string) (tmppath string, err error) {
 	tmpf, err := ioutil.TempFile("", "mtool")
 	if err != nil {
@@ -154,3 +198,19 @@ func getPicture(path string) (tmppath string, err error) {
 
 	return
 }
+
+// resolvePicture returns the path of imf's cover image, extracting it from
+// the master file with getPicture() if imf.PicturePath wasn't already
+// populated by an earlier stage of the pipeline.  cleanup removes the file
+// if this call is the one that extracted it; it is a no-op otherwise, since
+// the caller doesn't own a pre-populated PicturePath.
+func resolvePicture(imf db.ImageFile) (picPath string, cleanup func(), err error) {
+	if imf.PicturePath != "" {
+		return imf.PicturePath, func() {}, nil
+	}
+	picPath, err = getPicture(imf.MasterPath)
+	if err != nil {
+		return "", func() {}, err
+	}
+	return picPath, func() { os.Remove(picPath) }, nil
+}
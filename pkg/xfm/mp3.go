@@ -1,6 +1,7 @@
 package xfm
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -9,6 +10,19 @@ import (
 	"github.com/mdickers47/mtool/pkg/db"
 )
 
+func init() {
+	Register(mp3Transcoder{})
+}
+
+// mp3Transcoder adapts ImageMp3/MakeMp3 to the Transcoder interface.
+type mp3Transcoder struct{}
+
+func (mp3Transcoder) Name() string                                  { return "mp3" }
+func (mp3Transcoder) PlanImages(mfs []db.MasterFile) []db.ImageFile { return ImageMp3(mfs) }
+func (mp3Transcoder) Encode(ctx context.Context, imf db.ImageFile) error {
+	return MakeMp3(ctx, imf)
+}
+
 func ImageMp3(mfs []db.MasterFile) []db.ImageFile {
 
 	imfs := make([]db.ImageFile, 0, 100)
@@ -21,13 +35,19 @@ func ImageMp3(mfs []db.MasterFile) []db.ImageFile {
 			var imf db.ImageFile
 			imf.MasterPath = mf.Path
 			imf.MasterMtime = mf.Mtime
-			imf.AlbumArtist = mf.Artist
+			imf.ContentHash = mf.ContentHash
+			imf.Artist = mf.Artist
+			imf.Title = mf.Title[i]
 			imf.Album = mf.Album
 			imf.Date = mf.Date
-			imf.Artist, imf.Title, imf.Track = mf.GetTrackTags(i)
+			if mf.TrackNum > 0 {
+				imf.Track = mf.TrackNum
+			} else {
+				imf.Track = i + 1
+			}
 			imf.HasPicture = mf.HasPicture
 			imf.ImagePath = fmt.Sprintf("%v/%v/%02d %.32v.mp3",
-				pathSafe(imf.AlbumArtist), pathSafe(imf.Album), imf.Track,
+				pathSafe(imf.Artist), pathSafe(imf.Album), imf.Track,
 				pathSafe(imf.Title))
 			imfs = append(imfs, imf)
 		}
@@ -35,7 +55,7 @@ func ImageMp3(mfs []db.MasterFile) []db.ImageFile {
 	return imfs
 }
 
-func MakeMp3(imf db.ImageFile) error {
+func MakeMp3(ctx context.Context, imf db.ImageFile) error {
 
 	var flacargs []string
 
@@ -87,8 +107,8 @@ func MakeMp3(imf db.ImageFile) error {
 	}
 
 	// hook up pipeline
-	flaccmd := exec.Command(flacargs[0], flacargs[1:]...)
-	mp3cmd := exec.Command(mp3args[0], mp3args[1:]...)
+	flaccmd := exec.CommandContext(ctx, flacargs[0], flacargs[1:]...)
+	mp3cmd := exec.CommandContext(ctx, mp3args[0], mp3args[1:]...)
 	if mp3cmd.Stdin, err = flaccmd.StdoutPipe(); err != nil {
 		return err
 	}
@@ -1,6 +1,8 @@
 package xfm
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -9,6 +11,19 @@ import (
 	"github.com/mdickers47/mtool/pkg/db"
 )
 
+func init() {
+	Register(opusTranscoder{})
+}
+
+// opusTranscoder adapts ImageOpus/MakeOpus to the Transcoder interface.
+type opusTranscoder struct{}
+
+func (opusTranscoder) Name() string                                  { return "opus" }
+func (opusTranscoder) PlanImages(mfs []db.MasterFile) []db.ImageFile { return ImageOpus(mfs) }
+func (opusTranscoder) Encode(ctx context.Context, imf db.ImageFile) error {
+	return MakeOpus(ctx, imf)
+}
+
 func ImageOpus(mfs []db.MasterFile) []db.ImageFile {
 
 	imfs := make([]db.ImageFile, 0, 100)
@@ -21,6 +36,7 @@ func ImageOpus(mfs []db.MasterFile) []db.ImageFile {
 			var imf db.ImageFile
 			imf.MasterPath = mf.Path
 			imf.MasterMtime = mf.Mtime
+			imf.ContentHash = mf.ContentHash
 			imf.Artist = mf.Artist
 			imf.Title = mf.Title[i]
 			imf.Album = mf.Album
@@ -40,7 +56,24 @@ func ImageOpus(mfs []db.MasterFile) []db.ImageFile {
 	return imfs
 }
 
-func MakeOpus(imf db.ImageFile) error {
+func MakeOpus(ctx context.Context, imf db.ImageFile) error {
+	stderr, err := runOpus(ctx, imf)
+	if err != nil {
+		if len(stderr) > 0 {
+			fmt.Print(stderr)
+		}
+		return err
+	}
+	fmt.Printf("created: %v\n", imf.ImagePath)
+	return nil
+}
+
+// runOpus does the actual flac|opusenc work behind MakeOpus.  It takes a
+// context so a canceled MakeImage run actually kills an in-flight job
+// instead of waiting for it, and it captures both commands' stderr instead
+// of letting it go straight to the terminal, so a caller like MakeOpus can
+// report it per-job instead of interleaving it across workers.
+func runOpus(ctx context.Context, imf db.ImageFile) (stderr string, err error) {
 
 	var flacargs []string
 
@@ -70,48 +103,47 @@ func MakeOpus(imf db.ImageFile) error {
 		"--date", imf.Date,
 		"--tracknumber", fmt.Sprintf("%v", imf.Track),
 		"--padding", "0"}
+	if kbps, ok := kbpsFor("opus"); ok {
+		opusargs = append(opusargs, "--bitrate", kbps)
+	}
 
 	// extract and inject cover image, if any.
 	if imf.HasPicture {
-		picfile, err := getPicture(imf.MasterPath)
+		picfile, cleanup, err := resolvePicture(imf)
 		if err != nil {
-			return fmt.Errorf("failed to extract cover art: %v", err)
+			return "", fmt.Errorf("failed to extract cover art: %v", err)
 		}
-		defer os.Remove(picfile)
+		defer cleanup()
 		opusargs = append(opusargs, "--picture", picfile)
 	}
 
 	opusargs = append(opusargs, "-", imf.ImagePath)
 
 	// create path for file to land (or get "exit 1")
-	err := os.MkdirAll(path.Dir(imf.ImagePath), 0755)
-	if err != nil {
-		return err
-		//return fmt.Errorf("failed to create path %v: %v",
-		//	path.Dir(imf.ImagePath), err)
+	if err := os.MkdirAll(path.Dir(imf.ImagePath), 0755); err != nil {
+		return "", err
 	}
 
 	// hook up pipeline
-	flaccmd := exec.Command(flacargs[0], flacargs[1:]...)
-	opuscmd := exec.Command(opusargs[0], opusargs[1:]...)
+	var flacerr, opuserr bytes.Buffer
+	flaccmd := exec.CommandContext(ctx, flacargs[0], flacargs[1:]...)
+	opuscmd := exec.CommandContext(ctx, opusargs[0], opusargs[1:]...)
+	flaccmd.Stderr = &flacerr
+	opuscmd.Stderr = &opuserr
 	if opuscmd.Stdin, err = flaccmd.StdoutPipe(); err != nil {
-		return err
+		return "", err
 	}
 
 	// make it go
 	if err := flaccmd.Start(); err != nil {
-		fmt.Printf("flac %v\n", flacargs)
-		return fmt.Errorf("crashed starting flac: %v", err)
+		return flacerr.String(), fmt.Errorf("crashed starting flac: %v", err)
 	}
 	if err := opuscmd.Run(); err != nil {
-		fmt.Printf("opusenc %v\n", opusargs)
-		return fmt.Errorf("crashed running opus: %v", err)
+		return opuserr.String(), fmt.Errorf("crashed running opus: %v", err)
 	}
 	if err := flaccmd.Wait(); err != nil {
-		fmt.Printf("flac %v\n", flacargs)
-		return fmt.Errorf("crashed waiting for flac: %v", err)
+		return flacerr.String(), fmt.Errorf("crashed waiting for flac: %v", err)
 	}
 
-	fmt.Printf("created: %v\n", imf.ImagePath)
-	return nil
+	return "", nil
 }
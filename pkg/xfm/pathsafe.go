@@ -0,0 +1,175 @@
+package xfm
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+var FsProfile = flag.String("fs-profile", defaultFsProfile,
+	"target filesystem for output paths: posix, ntfs, exfat, or hfs; "+
+		"controls which characters and names pathSafe() has to avoid. "+
+		"Defaults to a profile matching the OS mtool was built for, but "+
+		"e.g. a Linux box exporting a tree to a Windows car stereo over "+
+		"exFAT should pass -fs-profile=exfat explicitly.")
+
+// windowsReserved is the set of device names that Windows (and therefore
+// exFAT formatted for interchange with it) refuses as a path component,
+// regardless of extension -- "CON.txt" is just as illegal as "CON".
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// maxComponentLen is 255 on every profile here, but posix counts bytes
+// while ntfs/exfat/hfs count UTF-16 code units; truncateBytes/truncateUtf16
+// know the difference.
+const maxComponentLen = 255
+
+// pathSafe rewrites instr so it is a legal single path component on the
+// filesystem named by -fs-profile.  It is used everywhere a metadata field
+// (title, artist, album, ...) becomes part of an output path, since that
+// metadata can contain anything a tagger let the user type in.
+func pathSafe(instr string) string {
+	switch *FsProfile {
+	case "ntfs", "exfat":
+		return pathSafeNtfs(instr)
+	case "hfs":
+		return pathSafeHfs(instr)
+	default:
+		return pathSafePosix(instr)
+	}
+}
+
+func pathSafePosix(instr string) string {
+
+	nerf := func(r rune) rune {
+		switch r {
+		case '?', '*', '"', '\'', '!', '<', '>', '(', ')':
+			return -1 // this means 'delete' to strings.Map()
+		case '/', '\\', ':', '#':
+			return '-'
+		case '&':
+			return '+'
+		default:
+			if r < 0x20 {
+				// ASCII control characters, including NUL, are illegal
+				// in a posix path component too.
+				return -1
+			}
+			return r
+		}
+	}
+
+	outstr := strings.Map(nerf, instr)
+	outstr = truncateBytes(outstr, maxComponentLen)
+	return dotGuard(outstr)
+}
+
+// pathSafeNtfs handles both the "ntfs" and "exfat" profiles: exFAT is FAT's
+// successor and inherited the same illegal-character set and reserved-name
+// rule from Windows, so one function serves both.  Unlike pathSafePosix,
+// it leaves '&', '#', '(', ')', '!' and the apostrophe alone, since
+// NTFS/exFAT accept them.
+func pathSafeNtfs(instr string) string {
+
+	nerf := func(r rune) rune {
+		switch r {
+		case '<', '>', ':', '"', '/', '\\', '|', '?', '*':
+			return -1
+		default:
+			if r < 0x20 {
+				// ASCII control characters are illegal too.
+				return -1
+			}
+			return r
+		}
+	}
+
+	outstr := strings.Map(nerf, instr)
+	outstr = strings.TrimRight(outstr, ". ")
+	outstr = truncateUtf16(outstr, maxComponentLen)
+	return reserveGuard(outstr)
+}
+
+// pathSafeHfs handles HFS+/APFS, which are far more permissive than
+// NTFS/exFAT: the only illegal characters are ':' (the classic Mac path
+// separator, still reserved) and NUL, there is no reserved-name list, and
+// trailing dots/spaces are fine.  Component length is still measured in
+// UTF-16 code units, same as ntfs/exfat.  '/' and '\\' aren't legal on HFS+
+// either -- they're not reserved by the filesystem itself, but pathSafe's
+// contract is a single path component, and a bare '/' splits into one.
+func pathSafeHfs(instr string) string {
+
+	nerf := func(r rune) rune {
+		switch {
+		case r == ':' || r == '/' || r == '\\' || r == 0:
+			return '-'
+		default:
+			return r
+		}
+	}
+
+	outstr := strings.Map(nerf, instr)
+	outstr = truncateUtf16(outstr, maxComponentLen)
+	return dotGuard(outstr)
+}
+
+// reserveGuard prefixes outstr with "_" if its base name (before the first
+// dot) collides with one of Windows' reserved device names, and falls back
+// to "null" if nerf left nothing behind.
+func reserveGuard(outstr string) string {
+	if len(outstr) == 0 {
+		return "null"
+	}
+	base := outstr
+	if i := strings.IndexByte(outstr, '.'); i >= 0 {
+		base = outstr[:i]
+	}
+	if windowsReserved[strings.ToUpper(base)] {
+		return fmt.Sprintf("_%v", outstr)
+	}
+	return outstr
+}
+
+// dotGuard falls back to "null" if outstr is empty or is one of the
+// dot-special names ("." or "..") that name the current/parent directory
+// instead of a file in it -- legal characters on posix/hfs, but not a
+// legal single path component.
+func dotGuard(outstr string) string {
+	switch outstr {
+	case "", ".", "..":
+		return "null"
+	default:
+		return outstr
+	}
+}
+
+// truncateBytes cuts s to at most n bytes, at a rune boundary.
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !isRuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// truncateUtf16 cuts s to at most n UTF-16 code units, the unit
+// NTFS/exFAT/HFS+ count path component length in.
+func truncateUtf16(s string, n int) string {
+	units := utf16.Encode([]rune(s))
+	if len(units) <= n {
+		return s
+	}
+	return string(utf16.Decode(units[:n]))
+}
@@ -0,0 +1,8 @@
+//go:build darwin
+
+package xfm
+
+// defaultFsProfile is the -fs-profile default for whatever OS this binary
+// was built for; the flag still overrides it for cross-targeting a
+// different filesystem than the one mtool itself runs on.
+const defaultFsProfile = "hfs"
@@ -0,0 +1,61 @@
+package xfm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func FuzzPathSafe(f *testing.F) {
+	seeds := []string{
+		"Ordinary Title",
+		"CON",
+		"con.txt",
+		"PRN.m4a",
+		"trailing dot.",
+		"trailing space ",
+		"weird/chars\\here:too*?\"<>|",
+		"",
+		".",
+		"\x00",
+		"日本語のタイトル",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, profile := range []string{"posix", "ntfs", "exfat", "hfs"} {
+			old := *FsProfile
+			*FsProfile = profile
+			out := pathSafe(s)
+			*FsProfile = old
+
+			if len(out) == 0 {
+				t.Fatalf("profile %v: pathSafe(%q) returned empty string", profile, s)
+			}
+			if strings.ContainsRune(out, '/') || strings.ContainsRune(out, 0) {
+				t.Fatalf("profile %v: pathSafe(%q) = %q still contains a path "+
+					"separator or NUL", profile, s, out)
+			}
+			if (profile == "ntfs" || profile == "exfat") &&
+				windowsReserved[strings.ToUpper(strings.SplitN(out, ".", 2)[0])] {
+				t.Fatalf("profile %v: pathSafe(%q) = %q collides with a reserved name",
+					profile, s, out)
+			}
+
+			// posix is the one profile we can actually verify against a real
+			// filesystem, since that's what this test runs on.
+			if profile == "posix" {
+				dir := t.TempDir()
+				fd, err := os.Create(filepath.Join(dir, out))
+				if err != nil {
+					t.Fatalf("pathSafe(%q) = %q did not round-trip through "+
+						"os.Create: %v", s, out, err)
+				}
+				fd.Close()
+			}
+		}
+	})
+}
@@ -0,0 +1,8 @@
+//go:build !windows && !darwin
+
+package xfm
+
+// defaultFsProfile is the -fs-profile default for whatever OS this binary
+// was built for; a Linux box exporting a tree to a Windows or exFAT-
+// formatted target still overrides it at the command line.
+const defaultFsProfile = "posix"
@@ -0,0 +1,42 @@
+package xfm
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+)
+
+var Quality = flag.String("quality", "opus=128k,aac=160k,alac=lossless",
+	"comma-separated format=value bitrate/quality settings, e.g. "+
+		"\"opus=128k,aac=160k,alac=lossless\"; consulted by the opus and aac "+
+		"transcoders instead of a hard-coded bitrate. A format missing from "+
+		"this list, or set to \"lossless\", keeps that transcoder's own "+
+		"default.")
+
+// qualityFor returns the configured value for format (e.g. "160k"), or ""
+// if -quality doesn't mention it.
+func qualityFor(format string) string {
+	for _, pair := range strings.Split(*Quality, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if ok && strings.TrimSpace(k) == format {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// kbpsFor returns the numeric kbit/s a lossy transcoder should encode
+// format at, per -quality, and false if -quality doesn't set a usable
+// value for it (missing, explicitly "lossless", or not a plain number
+// optionally suffixed with "k").
+func kbpsFor(format string) (kbps string, ok bool) {
+	q := strings.ToLower(qualityFor(format))
+	if q == "" || q == "lossless" {
+		return "", false
+	}
+	q = strings.TrimSuffix(q, "k")
+	if _, err := strconv.Atoi(q); err != nil {
+		return "", false
+	}
+	return q, true
+}
@@ -0,0 +1,47 @@
+package xfm
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// skipListName is the file MakeImage maintains at the root of an output
+// tree, recording the image paths of jobs that have failed, so a re-run
+// over the same library doesn't keep re-encoding the same poison inputs.
+const skipListName = ".mtool-skip"
+
+// loadSkipList reads root's skip-list, if any, into a set of image paths.
+// A missing file just means nothing has failed yet.
+func loadSkipList(root string) (map[string]bool, error) {
+	skipped := make(map[string]bool)
+	f, err := os.Open(filepath.Join(root, skipListName))
+	if os.IsNotExist(err) {
+		return skipped, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			skipped[line] = true
+		}
+	}
+	return skipped, scanner.Err()
+}
+
+// appendSkipList records imagePath as failed in root's skip-list, so the
+// next run over root skips it unless -retry-failed is given.
+func appendSkipList(root, imagePath string) error {
+	f, err := os.OpenFile(filepath.Join(root, skipListName),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, imagePath)
+	return err
+}
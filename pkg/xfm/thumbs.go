@@ -0,0 +1,158 @@
+package xfm
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mdickers47/mtool/pkg/db"
+)
+
+var ThumbInterval = flag.Float64("thumb-interval", 10,
+	"seconds between frames in a thumbs sprite sheet, ignored if -thumb-count is set")
+var ThumbCount = flag.Int("thumb-count", 0,
+	"target number of frames in a thumbs sprite sheet, overrides -thumb-interval")
+var ThumbWidth = flag.Int("thumb-width", 160, "tile width in pixels for thumbs sprite sheets")
+var ThumbHeight = flag.Int("thumb-height", 90, "tile height in pixels for thumbs sprite sheets")
+var ThumbColumns = flag.Int("thumb-columns", 10, "tiles per row in a thumbs sprite sheet")
+
+func init() {
+	Register(thumbsTranscoder{})
+}
+
+// thumbsTranscoder adapts ImageThumbs/MakeThumbs to the Transcoder interface.
+type thumbsTranscoder struct{}
+
+func (thumbsTranscoder) Name() string                                  { return "thumbs" }
+func (thumbsTranscoder) PlanImages(mfs []db.MasterFile) []db.ImageFile { return ImageThumbs(mfs) }
+func (thumbsTranscoder) Encode(ctx context.Context, imf db.ImageFile) error {
+	return MakeThumbs(ctx, imf)
+}
+
+// ImageThumbs expands one video MasterFile into the ImageFile representing
+// its scrub-preview sprite sheet.  ImagePath is the sprite jpeg; MakeThumbs
+// writes a companion .vtt alongside it with the same basename.
+func ImageThumbs(mfs []db.MasterFile) []db.ImageFile {
+
+	imfs := make([]db.ImageFile, 0, 100)
+	for _, mf := range mfs {
+		if mf.Type != db.Video {
+			continue
+		}
+		var imf db.ImageFile
+		if len(mf.Show) > 0 {
+			imf.ImagePath = fmt.Sprintf("tv/%v/%v %v-sprite.jpg",
+				pathSafe(mf.Show), pathSafe(mf.Episode), pathSafe(mf.Title[0]))
+		} else {
+			imf.ImagePath = fmt.Sprintf("movies/%v/%v-sprite.jpg",
+				pathSafe(mf.Date), pathSafe(mf.Title[0]))
+		}
+		imf.MasterPath = mf.Path
+		imf.MasterMtime = mf.Mtime
+		imf.ContentHash = mf.ContentHash
+		imf.Title = mf.Title[0]
+
+		imfs = append(imfs, imf)
+	}
+
+	return imfs
+}
+
+func probeDuration(ctx context.Context, path string) (float64, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+func vttTimestamp(seconds float64) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	total := int64(seconds * 1000)
+	ms := total % 1000
+	total /= 1000
+	s := total % 60
+	total /= 60
+	m := total % 60
+	total /= 60
+	h := total
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, m, s, ms)
+}
+
+// MakeThumbs renders a sprite sheet of evenly-spaced frames from the master
+// video, plus a WebVTT file that maps playback time onto sprite.jpg#xywh=...
+// regions, for players' <track kind="metadata"> scrub previews.
+func MakeThumbs(ctx context.Context, imf db.ImageFile) error {
+
+	duration, err := probeDuration(ctx, imf.MasterPath)
+	if err != nil {
+		return fmt.Errorf("ffprobe failed on %v: %v", imf.MasterPath, err)
+	}
+
+	interval := *ThumbInterval
+	if *ThumbCount > 0 {
+		interval = duration / float64(*ThumbCount)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("bad sprite interval for %v: %v", imf.MasterPath, interval)
+	}
+
+	numTiles := int(duration/interval) + 1
+	cols := *ThumbColumns
+	rows := (numTiles + cols - 1) / cols
+
+	if err := os.MkdirAll(path.Dir(imf.ImagePath), 0755); err != nil {
+		return fmt.Errorf("failed to create path %v: %v", path.Dir(imf.ImagePath), err)
+	}
+
+	vf := fmt.Sprintf("fps=1/%v,scale=%v:%v,tile=%vx%v",
+		interval, *ThumbWidth, *ThumbHeight, cols, rows)
+	args := []string{
+		"-i", imf.MasterPath,
+		"-vf", vf,
+		"-frames:v", "1",
+		"-y", imf.ImagePath,
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("crashed running ffmpeg: %v", err)
+	}
+
+	vttPath := strings.TrimSuffix(imf.ImagePath, path.Ext(imf.ImagePath)) + ".vtt"
+	spriteBase := path.Base(imf.ImagePath)
+
+	var vtt bytes.Buffer
+	vtt.WriteString("WEBVTT\n\n")
+	for i := 0; i < numTiles; i++ {
+		start := float64(i) * interval
+		end := start + interval
+		if end > duration {
+			end = duration
+		}
+		x := (i % cols) * *ThumbWidth
+		y := (i / cols) * *ThumbHeight
+		fmt.Fprintf(&vtt, "%v --> %v\n%v#xywh=%v,%v,%v,%v\n\n",
+			vttTimestamp(start), vttTimestamp(end), spriteBase,
+			x, y, *ThumbWidth, *ThumbHeight)
+	}
+
+	if err := os.WriteFile(vttPath, vtt.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %v: %v", vttPath, err)
+	}
+
+	fmt.Printf("created: %v\n", imf.ImagePath)
+	return nil
+}
@@ -0,0 +1,47 @@
+package xfm
+
+import (
+	"context"
+	"sort"
+
+	"github.com/mdickers47/mtool/pkg/db"
+)
+
+// Transcoder is the pluggable interface for one output format.  Adding a
+// new target -- AAC for phones, MP3 V0 for car stereos, AV1, whatever --
+// means writing one of these and registering it from an init(), the same
+// way pkg/db's TagReader backends register themselves; MakeImage and the
+// info command select and list them by Name() instead of switching on a
+// hardcoded set of formats.
+type Transcoder interface {
+	// Name is how this transcoder is selected, e.g. by the "make"
+	// command's imager argument.
+	Name() string
+	// PlanImages expands master files into the ImageFiles this transcoder
+	// would produce for them, without actually encoding anything.
+	PlanImages(mfs []db.MasterFile) []db.ImageFile
+	// Encode does the actual transcode for one ImageFile.  It must run its
+	// child processes with exec.CommandContext(ctx, ...) so that canceling
+	// ctx (e.g. MakeImage stopping on SIGINT) actually kills them instead
+	// of letting them run to completion.
+	Encode(ctx context.Context, imf db.ImageFile) error
+}
+
+var transcoders = map[string]Transcoder{}
+
+// Register adds t to the set of transcoders selectable by name.  Called
+// from each transcoder's init().
+func Register(t Transcoder) {
+	transcoders[t.Name()] = t
+}
+
+// Transcoders returns all registered transcoders sorted by name, for
+// listing (e.g. by the info command).
+func Transcoders() []Transcoder {
+	out := make([]Transcoder, 0, len(transcoders))
+	for _, t := range transcoders {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out
+}
@@ -0,0 +1,209 @@
+package xfm
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+
+	"github.com/mdickers47/mtool/pkg/db"
+)
+
+var Language = flag.String("language", "eng",
+	"which streams to extract from master files")
+
+func init() {
+	Register(webmTranscoder{})
+}
+
+// webmTranscoder adapts ImageWebm/MakeWebm to the Transcoder interface.
+type webmTranscoder struct{}
+
+func (webmTranscoder) Name() string                                  { return "webm" }
+func (webmTranscoder) PlanImages(mfs []db.MasterFile) []db.ImageFile { return ImageWebm(mfs) }
+func (webmTranscoder) Encode(ctx context.Context, imf db.ImageFile) error {
+	return MakeWebm(ctx, imf)
+}
+
+func ImageWebm(mfs []db.MasterFile) []db.ImageFile {
+
+	imfs := make([]db.ImageFile, 0, 100)
+	for _, mf := range mfs {
+		if mf.Type != db.Video {
+			continue
+		}
+		var imf db.ImageFile
+		if len(mf.Show) > 0 {
+			imf.ImagePath = fmt.Sprintf("tv/%v/%v %v.mkv",
+				pathSafe(mf.Show), pathSafe(mf.Episode), pathSafe(mf.Title[0]))
+		} else {
+			imf.ImagePath = fmt.Sprintf("movies/%v/%v.mkv",
+				pathSafe(mf.Date), pathSafe(mf.Title[0]))
+		}
+		imf.MasterPath = mf.Path
+		imf.MasterMtime = mf.Mtime
+		imf.ContentHash = mf.ContentHash
+		imf.Date = mf.Date
+		imf.Title = mf.Title[0]
+		imf.Stream = mf.Stream
+		// these probably aren't present and won't be used, but what the hell
+		imf.Artist = mf.Artist
+		imf.Album = mf.Album
+
+		imfs = append(imfs, imf)
+	}
+
+	return imfs
+}
+
+// sortStreams orders the audio streams of imf by the language-preference
+// rule shared by MakeWebm and MakeHls:
+//
+// disposition default ahead of non-default
+// language *Language ahead of language != *Language
+// language "und" ahead of language != "und"
+// higher bitrate ahead of lower bitrate
+//
+// Language "und" is preferred over tracks correctly tagged with a
+// non-preferred language, because some DVDs leave the primary track
+// unmarked even when alternate audio tracks are correctly tagged.
+func sortStreams(imf db.ImageFile) []int {
+
+	type enumStream struct {
+		Index  int
+		Stream db.MpegStreamDesc
+	}
+
+	streams := make([]enumStream, 0, len(imf.Stream))
+	for i, sd := range imf.Stream {
+		if sd.Type == db.Audio {
+			streams = append(streams, enumStream{i, sd})
+		}
+	}
+
+	sort.SliceStable(streams, func(i, j int) bool {
+		si, sj := streams[i].Stream, streams[j].Stream
+		switch {
+		// disposition.default takes priority over everything else: the
+		// container's author already picked this one, and a DVD with
+		// several same-language tracks gives us no other way to choose.
+		case si.Default && !sj.Default:
+			return true
+		case !si.Default && sj.Default:
+			return false
+		case si.Language == *Language && sj.Language != *Language:
+			return true
+		case si.Language != *Language && sj.Language == *Language:
+			return false
+		case si.Language == "und" && sj.Language != "und":
+			return true
+		case si.Language != "und" && sj.Language == "und":
+			return false
+		default:
+			return si.Bitrate > sj.Bitrate
+		}
+	})
+
+	indices := make([]int, len(streams))
+	for i, s := range streams {
+		indices[i] = s.Index
+	}
+	return indices
+}
+
+func MakeWebm(ctx context.Context, imf db.ImageFile) error {
+	stderr, err := runWebmCtx(ctx, imf)
+	if err != nil {
+		if len(stderr) > 0 {
+			fmt.Print(stderr)
+		}
+		return err
+	}
+	fmt.Printf("created: %v\n", imf.ImagePath)
+	return nil
+}
+
+// runWebmCtx does the actual ffmpeg work behind MakeWebm.  It takes a
+// context so a canceled MakeImage run actually kills an in-flight job
+// instead of waiting for it, and it captures ffmpeg's stderr instead of
+// letting it go straight to the terminal, so a caller like MakeWebm can
+// report it per-job.
+func runWebmCtx(ctx context.Context, imf db.ImageFile) (stderr string, err error) {
+
+	var mapArgs []string
+
+	// we keep the first video stream; typically there is only one
+	for i, sd := range imf.Stream {
+		if sd.Type == db.Video {
+			mapArgs = append(mapArgs, "-map", fmt.Sprintf("0:%v", i))
+			break
+		}
+	}
+
+	// we are going to keep one audio stream, chosen by the shared
+	// language-preference sort.
+	audioStreams := sortStreams(imf)
+	if len(audioStreams) == 0 {
+		fmt.Printf("warning: no audio streams in %v", imf.MasterPath)
+	} else {
+		mapArgs = append(mapArgs, "-map", fmt.Sprintf("0:%v", audioStreams[0]))
+	}
+
+	// we keep all subtitle streams in $language, plus any stream marked
+	// forced regardless of language (typically translating foreign dialog
+	// in an otherwise-$language film).  They have to be repacked using
+	// the same dvd_subtitle codec, because "copy" craps out when moving
+	// from an MPEG master to a Matroska container.
+	for i, sd := range imf.Stream {
+		if sd.Type == db.Subtitle && (sd.Language == *Language || sd.Forced) {
+			mapArgs = append(mapArgs, "-map", fmt.Sprintf("0:%v", i))
+		}
+	}
+
+	const crf = 33
+
+	var lastStderr bytes.Buffer
+	runOnce := func(preArgs, codecArgs []string) error {
+		args := append([]string{}, preArgs...)
+		args = append(args,
+			"-probesize", "200M",
+			"-analyzeduration", "120M",
+			"-i", imf.MasterPath)
+		args = append(args, mapArgs...)
+		args = append(args, codecArgs...)
+		// arguments that control audio codec
+		args = append(args, "-c:a", "libopus", "-b:a", "192000")
+		// arguments that control subtitle codec
+		args = append(args, "-c:s", "dvd_subtitle")
+		// output file
+		args = append(args, imf.ImagePath)
+
+		lastStderr.Reset()
+		cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+		cmd.Stderr = &lastStderr
+		return cmd.Run()
+	}
+
+	if err := os.MkdirAll(path.Dir(imf.ImagePath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create path %v: %v",
+			path.Dir(imf.ImagePath), err)
+	}
+
+	preArgs, codecArgs, usedHw := hwVideoArgs(crf)
+	if err := runOnce(preArgs, codecArgs); err != nil {
+		if !usedHw {
+			return lastStderr.String(), fmt.Errorf("can't run: %v", err)
+		}
+		fmt.Printf("hwaccel encode of %v failed (%v), falling back to software\n",
+			imf.MasterPath, err)
+		if err := runOnce(nil, softwareVp9Args(crf)); err != nil {
+			return lastStderr.String(), fmt.Errorf("can't run: %v", err)
+		}
+	}
+
+	return "", nil
+}